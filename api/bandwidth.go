@@ -0,0 +1,6 @@
+package api
+
+// Bandwidth is the global cap on download bandwidth. Zero means no limit.
+type Bandwidth struct {
+	MaxBytesPerSecond uint64 `json:"max_bytes_per_second"`
+}
@@ -0,0 +1,10 @@
+package api
+
+// CredentialHost describes credentials configured for a host. The
+// credentials themselves are never included.
+type CredentialHost struct {
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	AuthType   string `json:"auth_type"`
+	Source     string `json:"source"`
+}
@@ -6,22 +6,86 @@ import (
 )
 
 type Download struct {
-	ID            string    `json:"id"`
-	URL           string    `json:"url"`
-	Checksum      string    `json:"checksum,omitempty"`
-	ChecksumType  string    `json:"checksum_type,omitempty"`
-	Metadata      *Metadata `json:"metadata"`
-	BytesRead     uint64    `json:"bytes_read"`
-	TimeStarted   time.Time `json:"time_started,omitempty"`
-	TimeRequested time.Time `json:"time_requested"`
-	TimeUpdated   time.Time `json:"time_updated,omitempty"`
-	Finished      bool      `json:"finished"`
+	ID                string            `json:"id"`
+	URL               string            `json:"url"`
+	Sources           []string          `json:"sources,omitempty"`
+	Checksum          string            `json:"checksum,omitempty"`
+	ChecksumType      string            `json:"checksum_type,omitempty"`
+	ExpectedChecksum  string            `json:"expected_checksum,omitempty"`
+	ChecksumVerdict   string            `json:"checksum_verdict,omitempty"`
+	Priority          int               `json:"priority"`
+	Version           uint              `json:"version"`
+	MaxBytesPerSecond uint64            `json:"max_bytes_per_second,omitempty"`
+	MaxSize           uint64            `json:"max_size,omitempty"`
+	HoldReason        string            `json:"hold_reason,omitempty"`
+	Metadata          *Metadata         `json:"metadata"`
+	BytesRead         uint64            `json:"bytes_read"`
+	TimeStarted       time.Time         `json:"time_started,omitempty"`
+	TimeRequested     time.Time         `json:"time_requested"`
+	TimeValidated     time.Time         `json:"time_validated,omitempty"`
+	TimeUpdated       time.Time         `json:"time_updated,omitempty"`
+	Finished          bool              `json:"finished"`
+	State             string            `json:"state"`
+	StateHistory      []StateTransition `json:"state_history,omitempty"`
+	Errors            []Error           `json:"errors,omitempty"`
+	AuthProfile       string            `json:"auth_profile,omitempty"`
+	Authenticated     bool              `json:"authenticated,omitempty"`
+	Proxy             string            `json:"proxy,omitempty"`
+	FinalURL          string            `json:"final_url,omitempty"`
+	Redirects         []Redirect        `json:"redirects,omitempty"`
+	Stages            []StageResult     `json:"stages,omitempty"`
+	Scan              *ScanResult       `json:"scan,omitempty"`
+	Quarantined       bool              `json:"quarantined,omitempty"`
+	Blob              string            `json:"blob,omitempty"`
 
 	Duration        time.Duration `json:"duration,omitempty"`
 	PercentComplete float32       `json:"percent_complete,omitempty"`
 	Links           []Link        `json:"links,omitempty"`
 }
 
+// PriorityUpdate is the body of a request to reprioritise a queued
+// download.
+type PriorityUpdate struct {
+	Priority int `json:"priority"`
+}
+
+// Redirect is a hop on the way to the download's data.
+type Redirect struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+}
+
+// StageResult is the outcome of a processing stage run after the data was
+// fetched.
+type StageResult struct {
+	Stage       string        `json:"stage"`
+	Succeeded   bool          `json:"succeeded"`
+	Error       string        `json:"error,omitempty"`
+	TimeStarted time.Time     `json:"time_started"`
+	Duration    time.Duration `json:"duration"`
+	Artifacts   []Artifact    `json:"artifacts,omitempty"`
+	Scan        *ScanResult   `json:"scan,omitempty"`
+}
+
+// ScanResult is the verdict of a malware scan.
+type ScanResult struct {
+	Scanner   string `json:"scanner"`
+	Verdict   string `json:"verdict"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// Artifact is a file produced by a processing stage.
+type Artifact struct {
+	Name     string `json:"name"`
+	Size     uint64 `json:"size"`
+	Checksum string `json:"sha256"`
+}
+
+type StateTransition struct {
+	State string    `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
 func (d *Download) ResolveLinks(linkResolver *LinkResolver, req *http.Request) {
 	// somehow populate links
 	d.Links = append(d.Links,
@@ -36,6 +100,12 @@ func (d *Download) ResolveLinks(linkResolver *LinkResolver, req *http.Request) {
 	d.Links = append(d.Links,
 		Link{Relation: "delete", Value: d.ID,
 			ValueID: "id", RouteName: "download-delete"})
+	d.Links = append(d.Links,
+		Link{Relation: "cancel", Value: d.ID,
+			ValueID: "id", RouteName: "download-cancel"})
+	d.Links = append(d.Links,
+		Link{Relation: "priority", Value: d.ID,
+			ValueID: "id", RouteName: "download-priority"})
 
 	linkResolver.ResolveLinks(req, &d.Links)
 }
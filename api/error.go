@@ -5,6 +5,8 @@ import (
 )
 
 type Error struct {
-	Time  time.Time `json:"time"`
-	Error string    `json:"error"`
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error"`
+	Attempt uint      `json:"attempt,omitempty"`
+	Kind    string    `json:"kind,omitempty"`
 }
@@ -2,10 +2,29 @@ package api
 
 // IncomingDownload ...
 type IncomingDownload struct {
-	RequestID    string `json:"request_id"`
-	URL          string `json:"url"`
-	Checksum     string `json:"checksum"`
-	ChecksumType string `json:"checksum_type"`
-	Callback     string `json:"callback"`
-	ETag         string `json:"etag"`
+	RequestID         string `json:"request_id"`
+	URL               string `json:"url"`
+	Checksum          string `json:"checksum"`
+	ChecksumType      string `json:"checksum_type"`
+	Callback          string `json:"callback"`
+	ETag              string `json:"etag"`
+	Segments          uint   `json:"segments,omitempty"`
+	Priority          int    `json:"priority,omitempty"`
+	MaxBytesPerSecond uint64 `json:"max_bytes_per_second,omitempty"`
+	MaxSize           uint64 `json:"max_size,omitempty"`
+	// MaxAge is in seconds.
+	MaxAge  uint `json:"max_age,omitempty"`
+	Refresh bool `json:"refresh,omitempty"`
+
+	Headers     map[string]string `json:"headers,omitempty"`
+	Auth        *IncomingAuth     `json:"auth,omitempty"`
+	AuthProfile string            `json:"auth_profile,omitempty"`
+}
+
+// IncomingAuth carries credentials for the origin. They are used to fetch
+// the download and never returned.
+type IncomingAuth struct {
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	BearerToken string `json:"bearer_token,omitempty"`
 }
@@ -15,4 +15,6 @@ type Metadata struct {
 	ETag         string    `json:"http_etag,omitempty"`
 	Expires      time.Time `json:"http_expires,omitempty"`
 	StatusCode   int       `json:"http_status_code,omitempty"`
+
+	Headers map[string][]string `json:"http_headers,omitempty"`
 }
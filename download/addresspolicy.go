@@ -0,0 +1,206 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// blockedNetworks are refused unless they are allowed by an
+// AddressPolicy.
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // protocol assignments, including some metadata services
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local, including fd00:ec2::254
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// ParseCIDRs splits a comma separated list of CIDR ranges. A bare IP
+// address is taken as a range holding just that address.
+func ParseCIDRs(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: '%s'", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockedAddressError is returned when a source resolves to an address
+// the AddressPolicy doesn't allow.
+type BlockedAddressError struct {
+	Host string
+	IP   net.IP
+}
+
+func (e BlockedAddressError) Error() string {
+	if e.IP == nil || e.IP.String() == e.Host {
+		return fmt.Sprintf("connections to %s are not allowed", e.Host)
+	}
+	return fmt.Sprintf("connections to %s (%s) are not allowed", e.Host, e.IP)
+}
+
+// AddressPolicy decides which addresses downloads may connect to, so
+// submitted URLs can't reach the loopback, link-local, private and metadata
+// ranges behind the worker. Deny is checked first, then Allow, and
+// anything else is allowed unless it is in one of those blocked ranges.
+type AddressPolicy struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+var (
+	nat64Network = mustParseCIDRs("64:ff9b::/96")[0]
+	sixToFour    = mustParseCIDRs("2002::/16")[0]
+)
+
+// embeddedIPv4 returns the IPv4 address within a NAT64 or 6to4 address,
+// or nil for any other.
+func embeddedIPv4(ip net.IP) net.IP {
+	switch {
+	case nat64Network.Contains(ip):
+		return net.IP(ip[12:16]).To4()
+	case sixToFour.Contains(ip):
+		return net.IP(ip[2:6]).To4()
+	}
+	return nil
+}
+
+// Allowed reports whether connections to ip are allowed.
+func (p *AddressPolicy) Allowed(ip net.IP) bool {
+	if p == nil {
+		return true
+	}
+
+	// IPv4-mapped IPv6 addresses are checked against the IPv4 ranges, as
+	// are NAT64 and 6to4 ones, which reach the IPv4 address they embed
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else if v4 := embeddedIPv4(ip); v4 != nil {
+		ip = v4
+	}
+
+	if containsIP(p.Deny, ip) {
+		return false
+	}
+	if containsIP(p.Allow, ip) {
+		return true
+	}
+	return !containsIP(blockedNetworks, ip)
+}
+
+// Control is for use as net.Dialer's Control. It is called with the
+// resolved address of every connection attempt, so a host name that
+// resolves somewhere else on a later lookup is checked again.
+func (p *AddressPolicy) Control(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !p.Allowed(ip) {
+		return BlockedAddressError{Host: host, IP: ip}
+	}
+	return nil
+}
+
+// CheckHost resolves host and checks every address it resolves to. It is
+// used where the worker doesn't make the connection itself, such as
+// requests sent through a proxy.
+func (p *AddressPolicy) CheckHost(ctx context.Context, host string) error {
+	if p == nil {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !p.Allowed(ip) {
+			return BlockedAddressError{Host: host, IP: ip}
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !p.Allowed(addr.IP) {
+			return BlockedAddressError{Host: host, IP: addr.IP}
+		}
+	}
+	return nil
+}
+
+// CheckURL checks the host of rawURL, so requests for blocked sources can
+// be turned away when they are submitted. Only http, https and ftp URLs
+// name the host connected to.
+func (p *AddressPolicy) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "ftp":
+		return p.CheckHost(ctx, u.Hostname())
+	}
+	return nil
+}
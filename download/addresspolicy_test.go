@@ -0,0 +1,121 @@
+package download
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddressPolicyAllowed(t *testing.T) {
+	allow, _ := ParseCIDRs("10.1.0.0/16, 127.0.0.1")
+	deny, _ := ParseCIDRs("203.0.113.0/24")
+	p := &AddressPolicy{Allow: allow, Deny: deny}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"169.254.169.254", false},
+		{"192.168.1.1", false},
+		{"127.0.0.2", false},
+		{"::1", false},
+		{"fd00:ec2::254", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::7f00:1", true},
+		{"64:ff9b::5db8:d822", true},
+		{"2002:c0a8:101::1", false},
+		{"2002:5db8:d822::1", true},
+		{"10.1.2.3", true},
+		{"127.0.0.1", true},
+		{"203.0.113.7", false},
+	}
+	for _, test := range tests {
+		if p.Allowed(net.ParseIP(test.ip)) != test.allowed {
+			t.Errorf("allowed(%s): expected %v", test.ip, test.allowed)
+		}
+	}
+}
+
+func TestTransportBlocksAddresses(t *testing.T) {
+	server := serveRedirects("http://169.254.169.254/latest/meta-data/")
+	defer server.Close()
+
+	client := NewHTTPClient(&Transport{Addresses: &AddressPolicy{}}, DefaultRedirectPolicy())
+	_, err := client.Get(server.URL + "/data")
+	if ErrorKind(err) != ErrorKindBlocked {
+		t.Errorf("loopback: expected blocked, got %v", err)
+	}
+	if IsRetryable(err) {
+		t.Errorf("loopback: expected %v not to be retried", err)
+	}
+
+	allow, _ := ParseCIDRs("127.0.0.1")
+	client = NewHTTPClient(&Transport{Addresses: &AddressPolicy{Allow: allow}}, DefaultRedirectPolicy())
+	res, err := client.Get(server.URL + "/data")
+	if err != nil {
+		t.Fatalf("allowed: %v", err)
+	}
+	res.Body.Close()
+
+	// each redirect hop is checked as it is connected to
+	_, err = client.Get(server.URL + "/start")
+	if ErrorKind(err) != ErrorKindBlocked {
+		t.Errorf("redirect: expected blocked, got %v", err)
+	}
+}
+
+func TestTransportChecksProxiedHosts(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(testContent))
+	}))
+	defer proxy.Close()
+
+	// the proxy is on loopback, but was configured rather than requested
+	proxies := &ProxyConfig{Default: mustParseURL(t, proxy.URL)}
+	client := NewHTTPClient(&Transport{Proxies: proxies, Addresses: &AddressPolicy{}}, nil)
+
+	res, err := client.Get("http://93.184.216.34/file")
+	if err != nil {
+		t.Fatalf("public: %v", err)
+	}
+	res.Body.Close()
+
+	_, err = client.Get("http://10.0.0.1/file")
+	if ErrorKind(err) != ErrorKindBlocked {
+		t.Errorf("private: expected blocked, got %v", err)
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	s := &Service{Addresses: &AddressPolicy{}}
+
+	if err := s.CheckSource("http://169.254.169.254/latest/meta-data/"); err == nil {
+		t.Errorf("metadata: expected an error")
+	}
+	if err := s.CheckSource("ftp://[::1]/file"); err == nil {
+		t.Errorf("loopback: expected an error")
+	}
+	if err := s.CheckSource("s3://bucket/key"); err != nil {
+		t.Errorf("s3: expected no error, got %v", err)
+	}
+}
+
+func TestTransportGuardsDirectRequestsToProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(testContent))
+	}))
+	defer proxy.Close()
+
+	// a download naming the proxy itself, sent direct, mustn't get the
+	// pass that connections to the proxy do
+	proxies := &ProxyConfig{Default: mustParseURL(t, proxy.URL), NoProxy: ParseNoProxy("127.0.0.1")}
+	client := NewHTTPClient(&Transport{Proxies: proxies, Addresses: &AddressPolicy{}}, nil)
+
+	_, err := client.Get(proxy.URL + "/file")
+	if ErrorKind(err) != ErrorKindBlocked {
+		t.Errorf("direct: expected blocked, got %v", err)
+	}
+}
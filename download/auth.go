@@ -0,0 +1,243 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Auth is what a worker adds to its requests to get past an origin's
+// authentication. It is kept in memory only, and never stored or echoed
+// back to clients.
+type Auth struct {
+	Headers     map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Username    string            `json:"username,omitempty" yaml:"username,omitempty"`
+	Password    string            `json:"password,omitempty" yaml:"password,omitempty"`
+	BearerToken string            `json:"bearer_token,omitempty" yaml:"bearer_token,omitempty"`
+
+	// DefaultHostCredentials lets downloads using this profile fall back
+	// to host credentials for any host, such as the netrc default entry.
+	// Only profiles can set it, as those credentials would otherwise be
+	// sent to whatever host a request names.
+	DefaultHostCredentials bool `json:"default_host_credentials,omitempty" yaml:"-"`
+
+	// hosts, includeDefault and own are set by Credentials.For so that
+	// host credentials can be looked up again for each redirect, with own
+	// being the part that isn't tied to a host.
+	hosts          *HostCredentials
+	includeDefault bool
+	own            *Auth
+}
+
+// IsEmpty ...
+func (a *Auth) IsEmpty() bool {
+	return a == nil || (len(a.Headers) == 0 && a.Username == "" && a.Password == "" && a.BearerToken == "")
+}
+
+// Apply adds the headers and credentials to req, returning it with a
+// context that lets the redirect policy redo them for each hop.
+func (a *Auth) Apply(req *http.Request) *http.Request {
+	if a == nil {
+		return req
+	}
+
+	a.set(req)
+
+	return req.WithContext(context.WithValue(req.Context(), authKey{}, &authHops{auth: a, applied: a}))
+}
+
+func (a *Auth) set(req *http.Request) {
+	if a == nil {
+		return
+	}
+
+	for name, value := range a.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if a.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+a.BearerToken)
+	} else if a.Username != "" || a.Password != "" {
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+}
+
+// Strip removes whatever Apply added to req.
+func (a *Auth) Strip(req *http.Request) {
+	if a == nil {
+		return
+	}
+
+	for name := range a.Headers {
+		req.Header.Del(name)
+	}
+
+	if a.BearerToken != "" || a.Username != "" || a.Password != "" {
+		req.Header.Del("Authorization")
+	}
+}
+
+// forHop returns the Auth for a redirect to u. Host credentials are
+// looked up again for u, while the rest only goes to the original host.
+func (a *Auth) forHop(u *url.URL, sameHost bool) *Auth {
+	if a.hosts == nil {
+		if sameHost {
+			return a
+		}
+		return nil
+	}
+
+	host := a.hosts.Lookup(u.String(), a.includeDefault)
+	if !sameHost {
+		return host
+	}
+	if host == nil && a.own == nil {
+		return nil
+	}
+	return host.Merge(a.own)
+}
+
+type authKey struct{}
+
+// authHops tracks the Auth applied to each hop of a request, as headers
+// are copied from one hop to the next.
+type authHops struct {
+	auth    *Auth
+	applied *Auth
+}
+
+// redirect replaces the Auth of the previous hop on req with the one for
+// its URL.
+func (h *authHops) redirect(req *http.Request, sameHost bool) {
+	h.applied.Strip(req)
+	h.applied = h.auth.forHop(req.URL, sameHost)
+	h.applied.set(req)
+}
+
+// Merge returns a copy of a with anything set in other taking precedence.
+func (a *Auth) Merge(other *Auth) *Auth {
+	merged := &Auth{Headers: make(map[string]string)}
+
+	for _, auth := range []*Auth{a, other} {
+		if auth == nil {
+			continue
+		}
+		for name, value := range auth.Headers {
+			merged.Headers[name] = value
+		}
+		if auth.Username != "" || auth.Password != "" {
+			merged.Username = auth.Username
+			merged.Password = auth.Password
+		}
+		if auth.BearerToken != "" {
+			merged.BearerToken = auth.BearerToken
+		}
+	}
+
+	return merged
+}
+
+// LoadAuthProfiles reads named Auth from a JSON object keyed by profile
+// name.
+func LoadAuthProfiles(profileFile string) (map[string]*Auth, error) {
+	data, err := ioutil.ReadFile(profileFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles map[string]*Auth
+	err = json.Unmarshal(data, &profiles)
+	if err != nil {
+		return nil, fmt.Errorf("auth profiles %s: %v", profileFile, err)
+	}
+
+	return profiles, nil
+}
+
+// Credentials holds the Auth sent with each download request until the
+// download finishes, along with the named profiles and per host
+// credentials configured on the server. Auth sent with a request doesn't
+// survive a restart; profiles are looked up again by name.
+type Credentials struct {
+	sync.RWMutex
+	Profiles map[string]*Auth
+	Hosts    *HostCredentials
+	auth     map[string]*Auth
+}
+
+// NewCredentials ...
+func NewCredentials() *Credentials {
+	return &Credentials{
+		Profiles: make(map[string]*Auth),
+		auth:     make(map[string]*Auth)}
+}
+
+// SetProfiles replaces the named profiles.
+func (c *Credentials) SetProfiles(profiles map[string]*Auth) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.Profiles = profiles
+}
+
+// HasProfile ...
+func (c *Credentials) HasProfile(name string) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	_, ok := c.Profiles[name]
+	return ok
+}
+
+// Set ...
+func (c *Credentials) Set(downloadID string, auth *Auth) {
+	if auth.IsEmpty() {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.auth[downloadID] = auth
+}
+
+// Forget ...
+func (c *Credentials) Forget(downloadID string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.auth, downloadID)
+}
+
+// For returns the Auth to fetch download with: the credentials for its
+// host, overridden by its profile, overridden by anything sent with the
+// request. Returns nil if there is none.
+func (c *Credentials) For(download *Download) *Auth {
+	if c == nil {
+		return nil
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	profile := c.Profiles[download.AuthProfile]
+	includeDefault := profile != nil && profile.DefaultHostCredentials
+	host := c.Hosts.Lookup(download.URL, includeDefault)
+	auth := c.auth[download.ID]
+	if host == nil && profile == nil && auth == nil {
+		return nil
+	}
+
+	merged := host.Merge(profile).Merge(auth)
+	merged.hosts = c.Hosts
+	merged.includeDefault = includeDefault
+	if profile != nil || auth != nil {
+		merged.own = profile.Merge(auth)
+	}
+
+	return merged
+}
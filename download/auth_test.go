@@ -0,0 +1,95 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthApplyPrefersBearerToken(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	auth := &Auth{
+		Headers:     map[string]string{"X-Api-Key": "some-key"},
+		Username:    "user",
+		Password:    "secret",
+		BearerToken: "some-token"}
+
+	req = auth.Apply(req)
+
+	if req.Header.Get("Authorization") != "Bearer some-token" {
+		t.Errorf("authorization: expected %s, got %s", "Bearer some-token", req.Header.Get("Authorization"))
+	}
+	if req.Header.Get("X-Api-Key") != "some-key" {
+		t.Errorf("header: expected %s, got %s", "some-key", req.Header.Get("X-Api-Key"))
+	}
+}
+
+func TestCredentialsForMergesRequestOverProfile(t *testing.T) {
+	c := NewCredentials()
+	c.SetProfiles(map[string]*Auth{
+		"origin": {
+			Headers:  map[string]string{"X-Team": "downloads"},
+			Username: "profile-user",
+			Password: "profile-secret"}})
+	c.Set("some-id", &Auth{Username: "request-user", Password: "request-secret"})
+
+	auth := c.For(&Download{ID: "some-id", AuthProfile: "origin"})
+
+	if auth.Username != "request-user" || auth.Password != "request-secret" {
+		t.Errorf("basic: expected request credentials, got %s", auth.Username)
+	}
+	if auth.Headers["X-Team"] != "downloads" {
+		t.Errorf("header: expected profile header, got %v", auth.Headers)
+	}
+
+	c.Forget("some-id")
+	if c.For(&Download{ID: "some-id"}) != nil {
+		t.Errorf("forget: expected no credentials")
+	}
+}
+
+func TestSaveSendsCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user, password, ok := req.BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader(testContent))
+	}))
+	defer server.Close()
+
+	fileStore := &MemoryFileStore{}
+	sender := &RecordingStatusSender{}
+	w := createTestWorker(fileStore, sender)
+
+	w.SaveWithStatus(context.Background(), &Download{
+		ID:           "some-dummy-downloadid",
+		URL:          server.URL,
+		ChecksumType: "sha256",
+		Auth:         &Auth{Username: "user", Password: "secret"},
+		Status:       &Status{}})
+
+	if sender.Last().State != StateSucceeded {
+		t.Errorf("state: expected %s, got %s", StateSucceeded, sender.Last().State)
+	}
+	if string(fileStore.Data) != testContent {
+		t.Errorf("data: expected %s, got %s", testContent, fileStore.Data)
+	}
+}
+
+func TestDownloadNeverStoresAuth(t *testing.T) {
+	d := &Download{ID: "some-id", Auth: &Auth{BearerToken: "some-token"}}
+
+	p, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(p), "some-token") {
+		t.Errorf("json: expected no credentials, got %s", p)
+	}
+}
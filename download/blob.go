@@ -0,0 +1,89 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+// BlobStore is implemented by file stores with a content addressable
+// layout, where downloads of identical data share one blob named by its
+// sha256 checksum. Once a download has a Blob the store's readers use it,
+// and Delete only removes the blob when no other download refers to it.
+type BlobStore interface {
+	// StoresBlobs reports whether the content addressable layout is in
+	// use.
+	StoresBlobs() bool
+	// Commit moves d's data into the blob for checksum, or drops it if
+	// the blob is already stored, and counts d as referring to it.
+	Commit(d *Download, checksum string) error
+}
+
+// BlobRefs lists the IDs of the downloads referring to a blob. It is
+// stored alongside the blob, one ID to a line.
+type BlobRefs []string
+
+// ParseBlobRefs ...
+func ParseBlobRefs(data []byte) BlobRefs {
+	var refs BlobRefs
+	for _, id := range strings.Split(string(data), "\n") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			refs = append(refs, id)
+		}
+	}
+	return refs
+}
+
+// Add counts id as referring to the blob, once however many times it is
+// added.
+func (r BlobRefs) Add(id string) BlobRefs {
+	for _, ref := range r {
+		if ref == id {
+			return r
+		}
+	}
+	return append(r, id)
+}
+
+// Remove ...
+func (r BlobRefs) Remove(id string) BlobRefs {
+	var refs BlobRefs
+	for _, ref := range r {
+		if ref != id {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// Bytes ...
+func (r BlobRefs) Bytes() []byte {
+	if len(r) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(r, "\n") + "\n")
+}
+
+// contentChecksum returns the sha256 checksum blobs are named by, reusing
+// the download's own checksum when it is already a sha256 one.
+func contentChecksum(d *Download, fileStore FileStore, statusWriter *StatusWriter) (string, error) {
+	if strings.EqualFold(d.ChecksumType, "sha256") {
+		return statusWriter.ChecksumString(), nil
+	}
+
+	reader, err := fileStore.GetReader(d)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
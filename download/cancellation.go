@@ -0,0 +1,76 @@
+package download
+
+import (
+	"context"
+	"sync"
+)
+
+// Cancellations tracks which downloads workers are fetching so they can be
+// stopped, and which queued downloads should be skipped when dequeued.
+type Cancellations struct {
+	sync.Mutex
+	running   map[string]context.CancelFunc
+	cancelled map[string]bool
+}
+
+// NewCancellations ...
+func NewCancellations() *Cancellations {
+	return &Cancellations{
+		running:   make(map[string]context.CancelFunc),
+		cancelled: make(map[string]bool)}
+}
+
+// Start returns the context a worker fetches the download under. It
+// returns false if the download was cancelled while it was queued.
+func (c *Cancellations) Start(id string) (context.Context, bool) {
+	if c == nil {
+		return context.Background(), true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.cancelled[id] {
+		delete(c.cancelled, id)
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.running[id] = cancel
+
+	return ctx, true
+}
+
+// Finish ...
+func (c *Cancellations) Finish(id string) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if cancel, ok := c.running[id]; ok {
+		cancel()
+		delete(c.running, id)
+	}
+}
+
+// Cancel stops the download if a worker is fetching it and returns true.
+// Otherwise the download is marked so it is skipped once dequeued.
+func (c *Cancellations) Cancel(id string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if cancel, ok := c.running[id]; ok {
+		cancel()
+		return true
+	}
+
+	c.cancelled[id] = true
+	return false
+}
@@ -0,0 +1,37 @@
+package download
+
+import "testing"
+
+func TestCancelQueuedDownloadIsSkipped(t *testing.T) {
+	c := NewCancellations()
+
+	if c.Cancel("some-id") {
+		t.Errorf("cancel: expected queued download not to be running")
+	}
+
+	if _, ok := c.Start("some-id"); ok {
+		t.Errorf("start: expected cancelled download to be skipped")
+	}
+
+	if _, ok := c.Start("some-id"); !ok {
+		t.Errorf("start: expected download to start once skipped")
+	}
+}
+
+func TestCancelRunningDownload(t *testing.T) {
+	c := NewCancellations()
+
+	ctx, _ := c.Start("some-id")
+	if !c.Cancel("some-id") {
+		t.Errorf("cancel: expected download to be running")
+	}
+
+	if ctx.Err() == nil {
+		t.Errorf("context: expected cancelled context")
+	}
+
+	c.Finish("some-id")
+	if c.Cancel("some-id") {
+		t.Errorf("cancel: expected finished download not to be running")
+	}
+}
@@ -11,31 +11,98 @@ import (
 	"time"
 )
 
+// ChecksumVerdict records how the computed checksum compared with the
+// one given in the request.
+type ChecksumVerdict string
+
+const (
+	// ChecksumUnverified means no checksum was requested, or the download
+	// hasn't finished yet.
+	ChecksumUnverified ChecksumVerdict = ""
+	// ChecksumMatched ...
+	ChecksumMatched ChecksumVerdict = "matched"
+	// ChecksumMismatched ...
+	ChecksumMismatched ChecksumVerdict = "mismatched"
+)
+
 // Download ...
 type Download struct {
-	ID            string `gorethink:"id,omitempty"`
-	URL           string
-	Checksum      string
-	ChecksumType  string
-	Metadata      *Metadata
-	Status        *Status
-	TimeStarted   time.Time
-	TimeRequested time.Time
-	Finished      bool
-	Errors        []Error
+	ID  string `gorethink:"id,omitempty"`
+	URL string
+	// Sources are other URLs requested with the checksum of this
+	// download's data, which were given this download rather than being
+	// fetched again.
+	Sources          []string
+	ExpectedChecksum string
+	Checksum         string
+	ChecksumType     string
+	ChecksumVerdict  ChecksumVerdict
+	Segments         uint
+	Priority         int
+	// Version counts the downloads of URL, starting at 1. Downloads made
+	// before versions were kept have none.
+	Version           uint
+	MaxBytesPerSecond uint64
+	MaxSize           uint64
+	Metadata          *Metadata
+	Status            *Status
+	TimeStarted       time.Time
+	TimeRequested     time.Time
+	TimeValidated     time.Time
+	State             State
+	StateHistory      []StateTransition
+	Errors            []Error
+	// AuthProfile names the server side credentials the download is
+	// fetched with. Authenticated downloads are never shared between
+	// requests.
+	AuthProfile   string
+	Authenticated bool
+
+	// Auth is filled in by the worker fetching the download and is never
+	// stored.
+	Auth *Auth `json:"-" gorethink:"-"`
+
+	// Proxy is the proxy the latest attempt went through, empty if it
+	// went direct.
+	Proxy string
+
+	// Stages records the processing stages run once the data was
+	// fetched.
+	Stages []StageResult
+	// Scan is the verdict of the latest malware scan, if there was one.
+	// Infected data is Quarantined if the file store can set it aside.
+	Scan        *ScanResult
+	Quarantined bool
+
+	// Blob is the sha256 checksum of the data when it is kept in a
+	// content addressable file store, shared with any other download of
+	// the same data.
+	Blob string
+
+	// HoldReason explains why a queued download hasn't started. It is
+	// worked out when listing and never stored.
+	HoldReason string `json:"-" gorethink:"-"`
 }
 
 // NewDownload ...
 func NewDownload(id string, request *Request, downloadTime time.Time) *Download {
 	d := Download{
-		ID:            id,
-		URL:           request.URL,
-		Checksum:      request.Checksum,
-		ChecksumType:  request.ChecksumType,
-		Status:        &Status{},
-		Metadata:      &Metadata{},
-		TimeRequested: downloadTime,
-		Errors:        make([]Error, 0)}
+		ID:                id,
+		URL:               request.URL,
+		ExpectedChecksum:  request.Checksum,
+		ChecksumType:      request.ChecksumType,
+		Segments:          request.Segments,
+		Priority:          request.Priority,
+		MaxBytesPerSecond: request.MaxBytesPerSecond,
+		MaxSize:           request.MaxSize,
+		AuthProfile:       request.AuthProfile,
+		Authenticated:     request.Authenticated(),
+		Status:            &Status{},
+		Metadata:          &Metadata{},
+		TimeRequested:     downloadTime,
+		State:             StateQueued,
+		StateHistory:      []StateTransition{{State: StateQueued, Time: downloadTime}},
+		Errors:            make([]Error, 0)}
 
 	if request.ETag != "" {
 		d.Metadata.ETag = request.ETag
@@ -57,6 +124,15 @@ func NewDownload(id string, request *Request, downloadTime time.Time) *Download
 	return &d
 }
 
+// VersionNumber is the download's place among the versions of its URL.
+// Downloads from before versions were kept count as the first.
+func (d *Download) VersionNumber() uint {
+	if d.Version == 0 {
+		return 1
+	}
+	return d.Version
+}
+
 // PercentComplete ...
 func (d *Download) PercentComplete() float32 {
 	if d.Metadata.Size > 0 {
@@ -75,25 +151,129 @@ func (d *Download) AverageBytesPerSecond() float32 {
 	return float32(float64(d.Status.BytesRead) / d.Duration().Seconds())
 }
 
+// IsFinished ...
+func (d *Download) IsFinished() bool {
+	return d.State.IsFinished()
+}
+
+// Succeeded ...
+func (d *Download) Succeeded() bool {
+	return d.State == StateSucceeded
+}
+
+// Infected reports whether a malware scan found anything in the data.
+func (d *Download) Infected() bool {
+	return d.Scan != nil && d.Scan.Verdict == ScanInfected
+}
+
+// Transition moves the download into state, recording when it happened.
+// Moving to the state it is already in does nothing.
+func (d *Download) Transition(state State, transitionTime time.Time) error {
+	if d.State == state {
+		return nil
+	}
+	if !d.State.CanTransition(state) {
+		return StateError{From: d.State, To: state}
+	}
+
+	d.State = state
+	d.StateHistory = append(d.StateHistory, StateTransition{State: state, Time: transitionTime})
+
+	return nil
+}
+
+// Resumable reports whether an earlier attempt at this download left
+// partial data that can be continued with a range request.
+func (d *Download) Resumable() bool {
+	if d.IsFinished() || d.TimeStarted.IsZero() || d.Metadata == nil {
+		return false
+	}
+	// segments leave holes in the stored data, so they can't be continued
+	if d.Status != nil && d.Status.Segments > 1 {
+		return false
+	}
+	return d.Metadata.RangeValidator() != ""
+}
+
+// SupportedChecksumType ...
+func SupportedChecksumType(checksumType string) bool {
+	switch strings.ToLower(checksumType) {
+	case "md5", "sha1", "sha256", "sha512":
+		return true
+	}
+	return false
+}
+
 // ValidateChecksum ...
 func (d *Download) ValidateChecksum(checksumType string) (string, error) {
-	switch strings.ToLower(checksumType) {
-	case "md5":
-		return checksumType, nil
-	case "sha1":
-		return checksumType, nil
-	case "sha256":
-		return checksumType, nil
-	case "sha512":
+	if SupportedChecksumType(checksumType) {
 		return checksumType, nil
 	}
 
 	return "sha256", fmt.Errorf("No hash found for %s defaulting to %s", d.ChecksumType, "sha256")
 }
 
+// ChecksumFailed ...
+func (d *Download) ChecksumFailed() bool {
+	return d.ChecksumVerdict == ChecksumMismatched
+}
+
+// checksumMatches reports whether checksum is the one given in the
+// request, or whether no checksum was given.
+func (d *Download) checksumMatches(checksum string) bool {
+	return d.ExpectedChecksum == "" || strings.EqualFold(strings.TrimSpace(d.ExpectedChecksum), checksum)
+}
+
+// AddSource records sourceURL as another source of the data. It reports
+// whether the URL wasn't already known.
+func (d *Download) AddSource(sourceURL string) bool {
+	if sourceURL == d.URL {
+		return false
+	}
+	for _, source := range d.Sources {
+		if source == sourceURL {
+			return false
+		}
+	}
+	d.Sources = append(d.Sources, sourceURL)
+	return true
+}
+
+// HasChecksum reports whether the data's checksum of checksumType is
+// checksum, either as computed when it was fetched or as the blob holding
+// it is named.
+func (d *Download) HasChecksum(checksumType string, checksum string) bool {
+	if d.Checksum != "" && strings.EqualFold(d.ChecksumType, checksumType) && strings.EqualFold(d.Checksum, checksum) {
+		return true
+	}
+	return d.Blob != "" && strings.EqualFold(checksumType, "sha256") && strings.EqualFold(d.Blob, checksum)
+}
+
+// VerifyChecksum compares the computed checksum with the expected one,
+// recording an error on the download if they differ.
+func (d *Download) VerifyChecksum(verifyTime time.Time) ChecksumVerdict {
+	if d.ExpectedChecksum == "" {
+		d.ChecksumVerdict = ChecksumUnverified
+	} else if d.checksumMatches(d.Checksum) {
+		d.ChecksumVerdict = ChecksumMatched
+	} else {
+		d.ChecksumVerdict = ChecksumMismatched
+
+		err := fmt.Errorf("%s checksum mismatch: expected=%s, actual=%s", d.ChecksumType, d.ExpectedChecksum, d.Checksum)
+		d.Errors = append(d.Errors, *NewError(d.ID, err, verifyTime))
+	}
+
+	return d.ChecksumVerdict
+}
+
 // Hash ...
 func (d *Download) Hash() (hash.Hash, error) {
-	switch strings.ToLower(d.ChecksumType) {
+	return NewHash(d.ChecksumType)
+}
+
+// NewHash returns the hash for one of the supported checksum types.
+func NewHash(checksumType string) (hash.Hash, error) {
+	switch strings.ToLower(checksumType) {
 	case "md5":
 		return md5.New(), nil
 	case "sha1":
@@ -104,7 +284,7 @@ func (d *Download) Hash() (hash.Hash, error) {
 		return sha512.New(), nil
 	}
 
-	return nil, fmt.Errorf("Invalid checksum type %s", d.ChecksumType)
+	return nil, fmt.Errorf("Invalid checksum type %s", checksumType)
 }
 
 // AddStatusUpdate ...
@@ -113,7 +293,43 @@ func (d *Download) AddStatusUpdate(statusUpdate *StatusUpdate) {
 	if d.TimeStarted.UTC() == beginningOfTime.UTC() {
 		d.TimeStarted = statusUpdate.Time
 	}
+	if statusUpdate.Metadata != nil {
+		if d.Metadata == nil {
+			d.Metadata = &Metadata{}
+		}
+		d.Metadata.Update(statusUpdate.Metadata)
+	}
+	if statusUpdate.Started {
+		d.Proxy = statusUpdate.Proxy
+	}
+	if statusUpdate.Stages != nil {
+		d.Stages = statusUpdate.Stages
+		for _, stage := range d.Stages {
+			if stage.Scan != nil {
+				d.Scan = stage.Scan
+			}
+		}
+	}
+	if statusUpdate.Quarantined {
+		d.Quarantined = true
+	}
+	if statusUpdate.Blob != "" {
+		d.Blob = statusUpdate.Blob
+	}
 	d.Checksum = statusUpdate.Checksum
-	d.Finished = statusUpdate.Finished
 	d.Status.AddStatusUpdate(statusUpdate)
+
+	if statusUpdate.State != "" {
+		state := statusUpdate.State
+		if state == StateSucceeded && d.VerifyChecksum(statusUpdate.Time) == ChecksumMismatched {
+			state = StateFailed
+		}
+
+		err := d.Transition(state, statusUpdate.Time)
+		if err != nil {
+			d.Errors = append(d.Errors, *NewError(d.ID, err, statusUpdate.Time))
+		} else if d.Succeeded() {
+			d.TimeValidated = statusUpdate.Time
+		}
+	}
 }
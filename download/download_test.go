@@ -0,0 +1,79 @@
+package download
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyChecksumMatchIgnoresCase(t *testing.T) {
+	d := &Download{ExpectedChecksum: "ABCDEF", Checksum: "abcdef"}
+
+	actual := d.VerifyChecksum(time.Now())
+	if actual != ChecksumMatched {
+		t.Errorf("verdict: expected %s, got %s", ChecksumMatched, actual)
+	}
+}
+
+func TestVerifyChecksumMismatchAddsError(t *testing.T) {
+	d := &Download{ExpectedChecksum: "abcdef", Checksum: "fedcba", ChecksumType: "sha256"}
+
+	actual := d.VerifyChecksum(time.Now())
+	if actual != ChecksumMismatched {
+		t.Errorf("verdict: expected %s, got %s", ChecksumMismatched, actual)
+	}
+
+	if len(d.Errors) != 1 {
+		t.Errorf("errors: expected %d, got %d", 1, len(d.Errors))
+	}
+}
+
+func TestVerifyChecksumNotRequested(t *testing.T) {
+	d := &Download{Checksum: "abcdef"}
+
+	actual := d.VerifyChecksum(time.Now())
+	if actual != ChecksumUnverified {
+		t.Errorf("verdict: expected unverified, got %s", actual)
+	}
+}
+
+func TestTransitionRecordsHistory(t *testing.T) {
+	d := NewDownload("some-dummy-downloadid", &Request{URL: "http://example.com/"}, time.Now())
+
+	err := d.Transition(StateRunning, time.Now())
+	if err != nil {
+		t.Errorf("transition: unexpected error %v", err)
+	}
+
+	if len(d.StateHistory) != 2 || d.StateHistory[1].State != StateRunning {
+		t.Errorf("state-history: expected queued then running, got %v", d.StateHistory)
+	}
+}
+
+func TestTransitionFromFinishedState(t *testing.T) {
+	d := &Download{State: StateSucceeded}
+
+	err := d.Transition(StateRunning, time.Now())
+	if err == nil {
+		t.Errorf("transition: expected error moving from %s to %s", StateSucceeded, StateRunning)
+	}
+}
+
+func TestFailedStatusUpdateMarksDownloadFailed(t *testing.T) {
+	d := &Download{State: StateRunning, Status: &Status{}, Metadata: &Metadata{}}
+
+	d.AddStatusUpdate(&StatusUpdate{State: StateFailed, Time: time.Now()})
+
+	if d.State != StateFailed {
+		t.Errorf("state: expected %s, got %s", StateFailed, d.State)
+	}
+}
+
+func TestChecksumMismatchMarksDownloadFailed(t *testing.T) {
+	d := &Download{State: StateRunning, ExpectedChecksum: "abcdef", Status: &Status{}, Metadata: &Metadata{}}
+
+	d.AddStatusUpdate(&StatusUpdate{State: StateSucceeded, Checksum: "fedcba", Time: time.Now()})
+
+	if d.State != StateFailed {
+		t.Errorf("state: expected %s, got %s", StateFailed, d.State)
+	}
+}
@@ -17,19 +17,99 @@ func ToAPIDownloadList(origList *[]*Download) *[]*api.Download {
 	return &rs
 }
 
+// ToAPIRedirects ...
+func ToAPIRedirects(redirects []Redirect) []api.Redirect {
+	if len(redirects) == 0 {
+		return nil
+	}
+
+	hops := make([]api.Redirect, len(redirects))
+	for i, r := range redirects {
+		hops[i] = api.Redirect{URL: r.URL, StatusCode: r.StatusCode}
+	}
+
+	return hops
+}
+
+// ToAPIScanResult ...
+func ToAPIScanResult(scan *ScanResult) *api.ScanResult {
+	if scan == nil {
+		return nil
+	}
+	return &api.ScanResult{Scanner: scan.Scanner, Verdict: string(scan.Verdict), Signature: scan.Signature}
+}
+
+// ToAPIStages ...
+func ToAPIStages(stages []StageResult) []api.StageResult {
+	if len(stages) == 0 {
+		return nil
+	}
+
+	results := make([]api.StageResult, len(stages))
+	for i, stage := range stages {
+		results[i] = api.StageResult{
+			Stage:       stage.Stage,
+			Succeeded:   stage.Succeeded(),
+			Error:       stage.Error,
+			TimeStarted: stage.TimeStarted,
+			Duration:    stage.Duration / time.Millisecond,
+			Scan:        ToAPIScanResult(stage.Scan)}
+		for _, artifact := range stage.Artifacts {
+			results[i].Artifacts = append(results[i].Artifacts, api.Artifact{
+				Name:     artifact.Name,
+				Size:     artifact.Size,
+				Checksum: artifact.Checksum})
+		}
+	}
+
+	return results
+}
+
+// ToAPIStateHistory ...
+func ToAPIStateHistory(history []StateTransition) []api.StateTransition {
+	transitions := make([]api.StateTransition, len(history))
+
+	for i, t := range history {
+		transitions[i] = api.StateTransition{State: string(t.State), Time: t.Time}
+	}
+
+	return transitions
+}
+
 func ToAPIDownload(dd *Download) *api.Download {
 	d := &api.Download{
-		ID:            dd.ID,
-		URL:           dd.URL,
-		Checksum:      dd.Checksum,
-		ChecksumType:  dd.ChecksumType,
-		TimeStarted:   dd.TimeStarted,
-		TimeRequested: dd.TimeRequested,
-		Finished:      dd.Finished,
-		Links:         make([]api.Link, 0)}
+		ID:                dd.ID,
+		URL:               dd.URL,
+		Sources:           dd.Sources,
+		Checksum:          dd.Checksum,
+		ChecksumType:      dd.ChecksumType,
+		ExpectedChecksum:  dd.ExpectedChecksum,
+		ChecksumVerdict:   string(dd.ChecksumVerdict),
+		Priority:          dd.Priority,
+		Version:           dd.VersionNumber(),
+		MaxBytesPerSecond: dd.MaxBytesPerSecond,
+		MaxSize:           dd.MaxSize,
+		HoldReason:        dd.HoldReason,
+		TimeStarted:       dd.TimeStarted,
+		TimeRequested:     dd.TimeRequested,
+		TimeValidated:     dd.TimeValidated,
+		Finished:          dd.IsFinished(),
+		State:             string(dd.State),
+		StateHistory:      ToAPIStateHistory(dd.StateHistory),
+		Errors:            ToAPIDownloadErrorList(dd.Errors),
+		AuthProfile:       dd.AuthProfile,
+		Authenticated:     dd.Authenticated,
+		Proxy:             dd.Proxy,
+		Stages:            ToAPIStages(dd.Stages),
+		Scan:              ToAPIScanResult(dd.Scan),
+		Quarantined:       dd.Quarantined,
+		Blob:              dd.Blob,
+		Links:             make([]api.Link, 0)}
 
 	if dd.Metadata != nil {
 		d.Metadata = ToAPIMetadata(dd.Metadata)
+		d.FinalURL = dd.Metadata.FinalURL
+		d.Redirects = ToAPIRedirects(dd.Metadata.Redirects)
 	}
 
 	if dd.Status != nil {
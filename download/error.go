@@ -1,14 +1,83 @@
 package download
 
 import (
-	"github.com/patdowney/downloaderd-common/common"
+	"errors"
+	"io"
+	"net"
 	"time"
+
+	"github.com/patdowney/downloaderd-common/common"
+)
+
+// Kinds of Error, telling failures to reach or trust the origin apart
+// from the origin refusing the request.
+const (
+	ErrorKindTLSVerification = "tls-verification"
+	ErrorKindTLS             = "tls"
+	ErrorKindNetwork         = "network"
+	ErrorKindHTTP            = "http"
+	ErrorKindRedirect        = "redirect"
+	ErrorKindTimeout         = "timeout"
+	ErrorKindRejected        = "rejected"
+	ErrorKindBlocked         = "blocked"
+	ErrorKindProcessing      = "processing"
+	ErrorKindInfected        = "infected"
 )
 
 // Error ...
 type Error struct {
 	common.TimestampedError
 	DownloadID string
+	// Attempt is the fetch attempt that failed, or zero for errors
+	// outside of fetching.
+	Attempt uint
+	// Kind is one of the ErrorKind constants, or empty for other errors.
+	Kind string
+}
+
+// IsTimeout reports whether err is any of the timeouts on fetching:
+// connecting, waiting for a response or data, or a stalled transfer.
+func IsTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// ErrorKind classifies err as one of the ErrorKind constants, or returns
+// "" if it is none of them.
+func ErrorKind(err error) string {
+	var httpErr HTTPError
+	var redirectErr RedirectError
+	var sizeErr SizeLimitError
+	var typeErr ContentTypeError
+	var blockedErr BlockedAddressError
+	var stageErr StageError
+	var infectedErr InfectedError
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.As(err, &infectedErr):
+		return ErrorKindInfected
+	case errors.As(err, &stageErr):
+		return ErrorKindProcessing
+	case errors.As(err, &blockedErr):
+		return ErrorKindBlocked
+	case IsTLSVerificationError(err):
+		return ErrorKindTLSVerification
+	case IsTLSError(err):
+		return ErrorKindTLS
+	case IsTimeout(err):
+		return ErrorKindTimeout
+	case errors.As(err, &httpErr):
+		return ErrorKindHTTP
+	case errors.As(err, &redirectErr):
+		return ErrorKindRedirect
+	case errors.As(err, &sizeErr), errors.As(err, &typeErr):
+		return ErrorKindRejected
+	case errors.As(err, &opErr), errors.As(err, &dnsErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorKindNetwork
+	}
+	return ""
 }
 
 // NewError ...
@@ -15,3 +15,23 @@ func ToAPIError(e *common.TimestampedError) *api.Error {
 
 	return err
 }
+
+// ToAPIDownloadError ...
+func ToAPIDownloadError(e *Error) *api.Error {
+	err := ToAPIError(&e.TimestampedError)
+	err.Attempt = e.Attempt
+	err.Kind = e.Kind
+
+	return err
+}
+
+// ToAPIDownloadErrorList ...
+func ToAPIDownloadErrorList(origList []Error) []api.Error {
+	errs := make([]api.Error, len(origList))
+
+	for i := range origList {
+		errs[i] = *ToAPIDownloadError(&origList[i])
+	}
+
+	return errs
+}
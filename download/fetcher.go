@@ -0,0 +1,60 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/patdowney/downloaderd-common/common"
+)
+
+// Source is an open stream of a download's data.
+type Source struct {
+	io.ReadCloser
+	// Offset is where the stream starts. It is zero when the source
+	// couldn't continue from the offset asked for and sends everything.
+	Offset   uint64
+	Metadata *Metadata
+}
+
+// Fetcher opens the data for a download, continuing from offset when it
+// can. Workers choose a Fetcher by the scheme of the download's URL.
+type Fetcher interface {
+	Fetch(ctx context.Context, download *Download, offset uint64) (*Source, error)
+}
+
+// DefaultFetchers returns the fetchers for http and https URLs, which
+// send their requests with client and note when by clock.
+func DefaultFetchers(client *http.Client, clock common.Clock) map[string]Fetcher {
+	httpFetcher := &HTTPFetcher{Client: client, Clock: clock}
+
+	return map[string]Fetcher{
+		"http":  httpFetcher,
+		"https": httpFetcher}
+}
+
+// Scheme returns the lower case scheme of rawURL.
+func Scheme(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme
+}
+
+// IsHTTP ...
+func IsHTTP(rawURL string) bool {
+	scheme := Scheme(rawURL)
+	return scheme == "http" || scheme == "https"
+}
+
+// UnsupportedSchemeError ...
+type UnsupportedSchemeError struct {
+	Scheme string
+}
+
+func (e UnsupportedSchemeError) Error() string {
+	return fmt.Sprintf("no fetcher for %s:// urls", e.Scheme)
+}
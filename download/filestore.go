@@ -7,6 +7,19 @@ import (
 type FileStore interface {
 	Delete(*Download) (bool, error)
 	GetWriter(*Download) (io.WriteCloser, error)
+	GetResumeWriter(*Download, uint64) (io.WriteCloser, error)
 	GetReader(*Download) (io.ReadCloser, error)
 	Verify(*Download) (bool, error)
 }
+
+// WriterAtCloser ...
+type WriterAtCloser interface {
+	io.WriterAt
+	io.Closer
+}
+
+// SegmentedFileStore is implemented by file stores that can have the
+// segments of a download written in place, in any order.
+type SegmentedFileStore interface {
+	GetWriterAt(*Download) (WriterAtCloser, error)
+}
@@ -0,0 +1,99 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// RevalidateTimeout bounds how long a request waits on the origin to say
+// whether a stored download is still current. An origin that doesn't
+// answer in time leaves the stored download in place.
+const RevalidateTimeout = 5 * time.Second
+
+// Stale reports whether the origin should be asked about d again before
+// it is handed to request. Downloads still in progress are never stale,
+// while ones that finished without succeeding always are, so a new
+// request tries them again.
+func (d *Download) Stale(request *Request, now time.Time) bool {
+	if !d.IsFinished() {
+		return false
+	}
+	if request.Refresh || !d.Succeeded() {
+		return true
+	}
+
+	if request.MaxAge > 0 {
+		return now.Sub(d.LastValidated()) > request.MaxAge
+	}
+
+	return d.Metadata != nil && !d.Metadata.Expires.IsZero() && now.After(d.Metadata.Expires)
+}
+
+// LastValidated is when the stored data was last known to match the
+// origin.
+func (d *Download) LastValidated() time.Time {
+	if !d.TimeValidated.IsZero() {
+		return d.TimeValidated
+	}
+	if d.Status != nil {
+		return d.Status.UpdateTime
+	}
+	return d.TimeRequested
+}
+
+// Revalidate asks the origin whether the stored copy of d is still
+// current, using its validators in a conditional HEAD sent with auth. It
+// returns the metadata the origin sent along with its answer.
+func Revalidate(ctx context.Context, client *http.Client, d *Download, auth *Auth) (bool, *Metadata, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", d.URL, nil)
+	if err != nil {
+		return false, nil, err
+	}
+	req = auth.Apply(req)
+
+	stored := d.Metadata
+	if stored == nil {
+		stored = &Metadata{}
+	}
+	if stored.ETag != "" {
+		req.Header.Set("If-None-Match", stored.ETag)
+	}
+	if !stored.LastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", stored.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, nil, err
+	}
+	res.Body.Close()
+
+	metadata := MetadataFromResponse(res, time.Now())
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return true, metadata, nil
+	case http.StatusOK:
+		// not every origin answers conditional HEAD requests
+		return unchanged(stored, metadata), metadata, nil
+	}
+
+	return false, metadata, NewHTTPError("Head", res)
+}
+
+func unchanged(stored *Metadata, current *Metadata) bool {
+	if stored.ETag != "" || current.ETag != "" {
+		return stored.ETag == current.ETag
+	}
+	return !stored.LastModified.IsZero() && stored.LastModified.Equal(current.LastModified)
+}
+
+// Revalidated records that the origin confirmed the stored data is still
+// current. Only the timestamps change.
+func (d *Download) Revalidated(metadata *Metadata, validatedTime time.Time) {
+	d.TimeValidated = validatedTime
+	if d.Metadata != nil && !metadata.Expires.IsZero() {
+		d.Metadata.Expires = metadata.Expires
+	}
+}
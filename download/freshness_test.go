@@ -0,0 +1,88 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createSucceededDownload(url string, validated time.Time) *Download {
+	return &Download{
+		URL:           url,
+		State:         StateSucceeded,
+		TimeValidated: validated,
+		Metadata:      &Metadata{ETag: `"v1"`},
+		Status:        &Status{}}
+}
+
+func TestStaleByMaxAge(t *testing.T) {
+	now := time.Now()
+	d := createSucceededDownload("http://example.com/", now.Add(-time.Hour))
+
+	if d.Stale(&Request{MaxAge: 2 * time.Hour}, now) {
+		t.Errorf("stale: expected download within max-age to be fresh")
+	}
+	if !d.Stale(&Request{MaxAge: time.Minute}, now) {
+		t.Errorf("stale: expected download older than max-age to be stale")
+	}
+}
+
+func TestStaleByExpires(t *testing.T) {
+	now := time.Now()
+	d := createSucceededDownload("http://example.com/", now.Add(-time.Hour))
+
+	if d.Stale(&Request{}, now) {
+		t.Errorf("stale: expected download without expiry to be fresh")
+	}
+
+	d.Metadata.Expires = now.Add(-time.Minute)
+	if !d.Stale(&Request{}, now) {
+		t.Errorf("stale: expected expired download to be stale")
+	}
+}
+
+func TestStaleIgnoresUnfinished(t *testing.T) {
+	d := &Download{State: StateRunning}
+
+	if d.Stale(&Request{Refresh: true}, time.Now()) {
+		t.Errorf("stale: expected running download to be left alone")
+	}
+}
+
+func TestStaleRetriesUnsuccessful(t *testing.T) {
+	for _, state := range []State{StateFailed, StateCancelled} {
+		d := &Download{State: state}
+
+		if !d.Stale(&Request{}, time.Now()) {
+			t.Errorf("stale(%s): expected download to be fetched again", state)
+		}
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("ETag", etag)
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader(testContent))
+	}))
+	defer server.Close()
+
+	d := createSucceededDownload(server.URL, time.Now())
+
+	current, _, err := Revalidate(context.Background(), http.DefaultClient, d, nil)
+	if err != nil || !current {
+		t.Errorf("revalidate: expected unchanged resource to be current, got %v, %v", current, err)
+	}
+
+	etag = `"v2"`
+	current, metadata, err := Revalidate(context.Background(), http.DefaultClient, d, nil)
+	if err != nil || current {
+		t.Errorf("revalidate: expected changed resource not to be current, got %v, %v", current, err)
+	}
+	if metadata.ETag != etag {
+		t.Errorf("etag: expected %s, got %s", etag, metadata.ETag)
+	}
+}
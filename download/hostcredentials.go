@@ -0,0 +1,328 @@
+package download
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// HostCredential is the Auth used for URLs on Host whose path is within
+// PathPrefix. An empty Host matches any host, like the netrc default
+// entry, so such entries are only used for downloads whose profile opts
+// in to them.
+type HostCredential struct {
+	Host       string `json:"host" yaml:"host"`
+	PathPrefix string `json:"path_prefix,omitempty" yaml:"path_prefix,omitempty"`
+	Auth       `yaml:",inline"`
+
+	// Source is the file the credential was loaded from.
+	Source string `json:"-" yaml:"-"`
+}
+
+// AuthType describes the kind of credential without revealing it.
+func (c *HostCredential) AuthType() string {
+	switch {
+	case c.BearerToken != "":
+		return "bearer"
+	case c.Username != "" || c.Password != "":
+		return "basic"
+	default:
+		return "headers"
+	}
+}
+
+func (c *HostCredential) matches(u *url.URL, includeDefault bool) bool {
+	if c.Host == "" && !includeDefault {
+		return false
+	}
+	if c.Host != "" && !strings.EqualFold(c.Host, u.Host) && !strings.EqualFold(c.Host, u.Hostname()) {
+		return false
+	}
+	return withinPath(u.Path, c.PathPrefix)
+}
+
+// withinPath reports whether urlPath is prefix or below it, so /repo
+// covers /repo/file but not /repository.
+func withinPath(urlPath string, prefix string) bool {
+	if !strings.HasPrefix(urlPath, prefix) {
+		return false
+	}
+	return len(urlPath) == len(prefix) || strings.HasSuffix(prefix, "/") || urlPath[len(prefix)] == '/'
+}
+
+// moreSpecific reports whether c names its host where other doesn't, or
+// has a longer path prefix for the same kind of host.
+func (c *HostCredential) moreSpecific(other *HostCredential) bool {
+	if (c.Host == "") != (other.Host == "") {
+		return c.Host != ""
+	}
+	return len(c.PathPrefix) > len(other.PathPrefix)
+}
+
+// ParseNetrc reads the machine and default entries of a netrc file.
+// Macro definitions and accounts are skipped.
+func ParseNetrc(r io.Reader) ([]HostCredential, error) {
+	var entries []HostCredential
+	current := -1
+	inMacro := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// a macro runs until the next blank line
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			token := fields[i]
+			if strings.HasPrefix(token, "#") {
+				break
+			}
+
+			if token == "default" {
+				entries = append(entries, HostCredential{})
+				current = len(entries) - 1
+				continue
+			}
+			if token == "macdef" {
+				inMacro = true
+				break
+			}
+
+			if i+1 == len(fields) {
+				return nil, fmt.Errorf("netrc: missing value for %s", token)
+			}
+			i++
+			value := fields[i]
+
+			switch token {
+			case "machine":
+				entries = append(entries, HostCredential{Host: value})
+				current = len(entries) - 1
+			case "login", "password", "account":
+				if current < 0 {
+					return nil, fmt.Errorf("netrc: %s outside of a machine entry", token)
+				}
+				if token == "login" {
+					entries[current].Username = value
+				} else if token == "password" {
+					entries[current].Password = value
+				}
+			default:
+				return nil, fmt.Errorf("netrc: unknown token %s", token)
+			}
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// LoadCredentialFile reads a list of HostCredential from a YAML file, or
+// from JSON if the file doesn't have a .yaml or .yml extension.
+func LoadCredentialFile(credentialFile string) ([]HostCredential, error) {
+	data, err := ioutil.ReadFile(credentialFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []HostCredential
+	switch strings.ToLower(filepath.Ext(credentialFile)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &entries)
+	default:
+		err = json.Unmarshal(data, &entries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("credentials %s: %v", credentialFile, err)
+	}
+
+	return entries, nil
+}
+
+// HostCredentials looks up origin credentials by host and path prefix. It
+// is loaded from a netrc file and a credential file, either of which may
+// be left empty, and reloads them when they change.
+type HostCredentials struct {
+	sync.RWMutex
+	NetrcFile      string
+	CredentialFile string
+
+	entries  []HostCredential
+	modTimes map[string]time.Time
+}
+
+// NewHostCredentials ...
+func NewHostCredentials(netrcFile string, credentialFile string) (*HostCredentials, error) {
+	c := &HostCredentials{
+		NetrcFile:      netrcFile,
+		CredentialFile: credentialFile}
+
+	err := c.Reload()
+
+	return c, err
+}
+
+func (c *HostCredentials) load() ([]HostCredential, map[string]time.Time, error) {
+	var entries []HostCredential
+
+	// entries from the credential file come first, so they win over netrc
+	// entries for the same host and prefix
+	if c.CredentialFile != "" {
+		loaded, err := LoadCredentialFile(c.CredentialFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range loaded {
+			e.Source = c.CredentialFile
+			entries = append(entries, e)
+		}
+	}
+
+	if c.NetrcFile != "" {
+		f, err := os.Open(c.NetrcFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		loaded, err := ParseNetrc(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", c.NetrcFile, err)
+		}
+		for _, e := range loaded {
+			e.Source = c.NetrcFile
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, c.currentModTimes(), nil
+}
+
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Reload reads the files again. The credentials already loaded are kept
+// if either file can't be read, until the files change again.
+func (c *HostCredentials) Reload() error {
+	entries, modTimes, err := c.load()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if err != nil {
+		c.modTimes = c.currentModTimes()
+		return err
+	}
+	c.entries = entries
+	c.modTimes = modTimes
+
+	return nil
+}
+
+func (c *HostCredentials) currentModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{c.CredentialFile, c.NetrcFile} {
+		if file != "" {
+			modTimes[file] = modTime(file)
+		}
+	}
+	return modTimes
+}
+
+func (c *HostCredentials) changed() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	for file, loaded := range c.modTimes {
+		if !modTime(file).Equal(loaded) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch checks the files for changes every interval, reloading them when
+// they have been modified.
+func (c *HostCredentials) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if !c.changed() {
+				continue
+			}
+
+			err := c.Reload()
+			if err != nil {
+				log.Printf("credentials-reload-error: %v", err)
+			} else {
+				log.Printf("credentials-reloaded")
+			}
+		}
+	}()
+}
+
+// Lookup returns the Auth for rawURL from the most specific matching
+// entry, or nil if none match. Entries for any host are only matched if
+// includeDefault is set.
+func (c *HostCredentials) Lookup(rawURL string, includeDefault bool) *Auth {
+	if c == nil {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	var best *HostCredential
+	for i := range c.entries {
+		e := &c.entries[i]
+		if !e.matches(u, includeDefault) {
+			continue
+		}
+		if best == nil || e.moreSpecific(best) {
+			best = e
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	auth := best.Auth
+	return &auth
+}
+
+// List returns the configured credentials in the order they were loaded.
+func (c *HostCredentials) List() []HostCredential {
+	if c == nil {
+		return nil
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	entries := make([]HostCredential, len(c.entries))
+	copy(entries, c.entries)
+
+	return entries
+}
@@ -0,0 +1,131 @@
+package download
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testNetrc = `# origin credentials
+machine example.com login netrc-user password netrc-secret
+
+machine macro.example.com login macro-user
+macdef init
+cd /pub
+quit
+
+default login anonymous password guest
+`
+
+func TestParseNetrc(t *testing.T) {
+	entries, err := ParseNetrc(strings.NewReader(testNetrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("entries: expected %d, got %d", 3, len(entries))
+	}
+	if entries[0].Host != "example.com" || entries[0].Username != "netrc-user" || entries[0].Password != "netrc-secret" {
+		t.Errorf("machine: expected example.com credentials, got %v", entries[0])
+	}
+	if entries[2].Host != "" || entries[2].Username != "anonymous" {
+		t.Errorf("default: expected anonymous credentials, got %v", entries[2])
+	}
+}
+
+func TestHostCredentialsLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostcredentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	netrcFile := filepath.Join(dir, "netrc")
+	ioutil.WriteFile(netrcFile, []byte(testNetrc), 0600)
+
+	credentialFile := filepath.Join(dir, "credentials.yaml")
+	ioutil.WriteFile(credentialFile, []byte(`
+- host: example.com
+  path_prefix: /private/
+  bearer_token: private-token
+`), 0600)
+
+	c, err := NewHostCredentials(netrcFile, credentialFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth := c.Lookup("http://example.com/private/file", false); auth == nil || auth.BearerToken != "private-token" {
+		t.Errorf("prefix: expected private-token, got %v", auth)
+	}
+	if auth := c.Lookup("http://example.com/public/file", false); auth == nil || auth.Username != "netrc-user" {
+		t.Errorf("host: expected netrc-user, got %v", auth)
+	}
+	if auth := c.Lookup("http://example.org:8080/file", true); auth == nil || auth.Username != "anonymous" {
+		t.Errorf("default: expected anonymous, got %v", auth)
+	}
+
+	ioutil.WriteFile(credentialFile, []byte(`
+- host: example.com
+  path_prefix: /private/
+  bearer_token: rotated-token
+`), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(credentialFile, later, later)
+
+	if !c.changed() {
+		t.Fatalf("changed: expected modified file to be noticed")
+	}
+	err = c.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := c.Lookup("http://example.com/private/file", false); auth == nil || auth.BearerToken != "rotated-token" {
+		t.Errorf("reload: expected rotated-token, got %v", auth)
+	}
+}
+
+func TestHostCredentialsDefaultNeedsOptIn(t *testing.T) {
+	entries, _ := ParseNetrc(strings.NewReader(testNetrc))
+	hosts := &HostCredentials{entries: entries}
+
+	if auth := hosts.Lookup("http://attacker.example.net/file", false); auth != nil {
+		t.Errorf("default: expected no credentials, got %v", auth)
+	}
+
+	c := NewCredentials()
+	c.Hosts = hosts
+	c.SetProfiles(map[string]*Auth{
+		"anonymous-ftp": {DefaultHostCredentials: true},
+		"token":         {BearerToken: "profile-token"}})
+
+	if auth := c.For(&Download{URL: "http://attacker.example.net/file"}); auth != nil {
+		t.Errorf("no profile: expected no credentials, got %v", auth)
+	}
+	if auth := c.For(&Download{URL: "http://attacker.example.net/file", AuthProfile: "token"}); auth == nil || auth.Username != "" {
+		t.Errorf("profile without opt in: expected no default credentials, got %v", auth)
+	}
+	if auth := c.For(&Download{URL: "ftp://mirror.example.net/file", AuthProfile: "anonymous-ftp"}); auth == nil || auth.Username != "anonymous" {
+		t.Errorf("profile with opt in: expected anonymous, got %v", auth)
+	}
+}
+
+func TestHostCredentialsPathPrefixBoundary(t *testing.T) {
+	hosts := &HostCredentials{entries: []HostCredential{
+		{Host: "example.com", PathPrefix: "/repo", Auth: Auth{BearerToken: "repo-token"}}}}
+
+	for _, path := range []string{"/repo", "/repo/", "/repo/file"} {
+		if auth := hosts.Lookup("http://example.com"+path, false); auth == nil || auth.BearerToken != "repo-token" {
+			t.Errorf("%s: expected repo-token, got %v", path, auth)
+		}
+	}
+	for _, path := range []string{"/repository-evil", "/repo-evil/file", "/"} {
+		if auth := hosts.Lookup("http://example.com"+path, false); auth != nil {
+			t.Errorf("%s: expected no credentials, got %v", path, auth)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package download
+
+import "github.com/patdowney/downloaderd-worker/api"
+
+// ToAPICredentialHosts ...
+func ToAPICredentialHosts(credentials []HostCredential) []api.CredentialHost {
+	hosts := make([]api.CredentialHost, len(credentials))
+
+	for i, c := range credentials {
+		hosts[i] = api.CredentialHost{
+			Host:       c.Host,
+			PathPrefix: c.PathPrefix,
+			AuthType:   c.AuthType(),
+			Source:     c.Source}
+	}
+
+	return hosts
+}
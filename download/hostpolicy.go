@@ -0,0 +1,233 @@
+package download
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patdowney/downloaderd-common/common"
+)
+
+// HostPolicy limits how hard workers press on an origin. Pattern is either
+// a host name or a wildcard such as "*.example.com", which matches every
+// subdomain and shares its limits between them.
+type HostPolicy struct {
+	Pattern        string
+	MaxConnections uint
+	Delay          time.Duration
+}
+
+// ParseHostPolicy reads a policy written as pattern=connections or
+// pattern=connections/delay, e.g. "*.example.com=2/500ms".
+func ParseHostPolicy(value string) (HostPolicy, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return HostPolicy{}, fmt.Errorf("host policy %q: expected pattern=connections[/delay]", value)
+	}
+	policy := HostPolicy{Pattern: strings.ToLower(parts[0])}
+
+	limits := strings.SplitN(parts[1], "/", 2)
+	connections, err := strconv.ParseUint(limits[0], 10, 32)
+	if err != nil {
+		return HostPolicy{}, fmt.Errorf("host policy %q: %v", value, err)
+	}
+	policy.MaxConnections = uint(connections)
+
+	if len(limits) == 2 {
+		policy.Delay, err = time.ParseDuration(limits[1])
+		if err != nil {
+			return HostPolicy{}, fmt.Errorf("host policy %q: %v", value, err)
+		}
+	}
+
+	return policy, nil
+}
+
+func (p HostPolicy) isWildcard() bool {
+	return strings.HasPrefix(p.Pattern, "*.")
+}
+
+// hostMatches reports whether host is pattern, or a subdomain of it when
+// pattern is a wildcard.
+func hostMatches(pattern string, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// bestHostMatch returns the index of the pattern that applies to host, or
+// -1 if none match. Exact host names win over wildcards, and longer
+// wildcards over shorter ones.
+func bestHostMatch(host string, count int, pattern func(int) string) int {
+	best := -1
+	for i := 0; i < count; i++ {
+		p := pattern(i)
+		if !hostMatches(p, host) {
+			continue
+		}
+		if !strings.HasPrefix(p, "*.") {
+			return i
+		}
+		if best < 0 || len(p) > len(pattern(best)) {
+			best = i
+		}
+	}
+	return best
+}
+
+type hostState struct {
+	active    uint
+	nextStart time.Time
+}
+
+// HostLimiter hands out connection slots according to the host policies.
+// Hosts without a policy of their own fall back to Default, where zero
+// values mean no limit.
+type HostLimiter struct {
+	sync.Mutex
+	Clock    common.Clock
+	Default  HostPolicy
+	Policies []HostPolicy
+	// OnChange is called whenever a held back host may have become
+	// eligible again.
+	OnChange func()
+
+	hosts map[string]*hostState
+}
+
+// NewHostLimiter ...
+func NewHostLimiter(policies []HostPolicy) *HostLimiter {
+	return &HostLimiter{
+		Clock:    &common.RealClock{},
+		Policies: policies,
+		hosts:    make(map[string]*hostState)}
+}
+
+// HostOf returns the host name requests for rawURL go to.
+func HostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// policyFor returns the policy applying to host and the key its state is
+// kept under. Exact host names win over wildcards, and longer wildcards
+// over shorter ones.
+func (l *HostLimiter) policyFor(host string) (HostPolicy, string) {
+	i := bestHostMatch(host, len(l.Policies), func(i int) string {
+		return l.Policies[i].Pattern
+	})
+	if i < 0 {
+		return l.Default, host
+	}
+
+	p := l.Policies[i]
+	if p.isWildcard() {
+		return p, p.Pattern
+	}
+	return p, host
+}
+
+func (l *HostLimiter) state(key string) *hostState {
+	s, ok := l.hosts[key]
+	if !ok {
+		s = &hostState{}
+		l.hosts[key] = s
+	}
+	return s
+}
+
+// prune forgets hosts with nothing open whose delay has passed, so hosts
+// fetched from once aren't tracked forever.
+func (l *HostLimiter) prune(now time.Time) {
+	for key, s := range l.hosts {
+		if s.active == 0 && !now.Before(s.nextStart) {
+			delete(l.hosts, key)
+		}
+	}
+}
+
+func (l *HostLimiter) holdReason(policy HostPolicy, key string, s *hostState, now time.Time) string {
+	if policy.MaxConnections > 0 && s.active >= policy.MaxConnections {
+		return fmt.Sprintf("%s has %d of %d connections open", key, s.active, policy.MaxConnections)
+	}
+	if now.Before(s.nextStart) {
+		return fmt.Sprintf("%s is delayed until %s", key, s.nextStart.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// HoldReason explains why a download from host can't start yet, or
+// returns "" if it can.
+func (l *HostLimiter) HoldReason(host string) string {
+	if l == nil {
+		return ""
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	// only looked up, so listing doesn't add hosts nothing was fetched from
+	policy, key := l.policyFor(host)
+	s, ok := l.hosts[key]
+	if !ok {
+		return ""
+	}
+	return l.holdReason(policy, key, s, l.Clock.Now())
+}
+
+// TryAcquire takes a connection slot for host if its policy allows one
+// now. Every successful call must be matched by a Release.
+func (l *HostLimiter) TryAcquire(host string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.Clock.Now()
+	l.prune(now)
+
+	policy, key := l.policyFor(host)
+	s := l.state(key)
+	if l.holdReason(policy, key, s, now) != "" {
+		return false
+	}
+
+	s.active++
+	if policy.Delay > 0 {
+		s.nextStart = now.Add(policy.Delay)
+		if l.OnChange != nil {
+			time.AfterFunc(policy.Delay, l.OnChange)
+		}
+	}
+
+	return true
+}
+
+// Release ...
+func (l *HostLimiter) Release(host string) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	_, key := l.policyFor(host)
+	s := l.state(key)
+	if s.active > 0 {
+		s.active--
+	}
+	l.prune(l.Clock.Now())
+	l.Unlock()
+
+	if l.OnChange != nil {
+		l.OnChange()
+	}
+}
@@ -0,0 +1,120 @@
+package download
+
+import (
+	"testing"
+	"time"
+
+	"github.com/patdowney/downloaderd-common/common"
+)
+
+func TestParseHostPolicy(t *testing.T) {
+	p, err := ParseHostPolicy("*.Example.com=2/500ms")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	expected := HostPolicy{Pattern: "*.example.com", MaxConnections: 2, Delay: 500 * time.Millisecond}
+	if p != expected {
+		t.Errorf("policy: expected %v, got %v", expected, p)
+	}
+
+	for _, invalid := range []string{"example.com", "=1", "example.com=x", "example.com=1/soon"} {
+		if _, err := ParseHostPolicy(invalid); err == nil {
+			t.Errorf("parse(%s): expected error", invalid)
+		}
+	}
+}
+
+func TestHostLimiterMaxConnections(t *testing.T) {
+	l := NewHostLimiter([]HostPolicy{{Pattern: "example.com", MaxConnections: 1}})
+
+	if !l.TryAcquire("example.com") {
+		t.Errorf("acquire: expected first connection to be allowed")
+	}
+	if l.TryAcquire("example.com") {
+		t.Errorf("acquire: expected second connection to be held back")
+	}
+	if l.HoldReason("example.com") == "" {
+		t.Errorf("hold-reason: expected a reason")
+	}
+	if !l.TryAcquire("other.com") {
+		t.Errorf("acquire: expected hosts without a policy to be unlimited")
+	}
+
+	l.Release("example.com")
+	if !l.TryAcquire("example.com") {
+		t.Errorf("acquire: expected connection to be allowed after release")
+	}
+}
+
+func TestHostLimiterHoldReasonDoesntTrackHosts(t *testing.T) {
+	l := NewHostLimiter([]HostPolicy{{Pattern: "example.com", MaxConnections: 1}})
+
+	for _, host := range []string{"example.com", "one.example.net", "two.example.net"} {
+		if reason := l.HoldReason(host); reason != "" {
+			t.Errorf("hold-reason(%s): expected none, got %s", host, reason)
+		}
+	}
+	if len(l.hosts) != 0 {
+		t.Errorf("hosts: expected none tracked, got %d", len(l.hosts))
+	}
+}
+
+func TestHostLimiterWildcardSharesLimit(t *testing.T) {
+	l := NewHostLimiter([]HostPolicy{
+		{Pattern: "*.example.com", MaxConnections: 1},
+		{Pattern: "fast.example.com", MaxConnections: 4}})
+
+	if !l.TryAcquire("a.example.com") {
+		t.Errorf("acquire: expected first connection to be allowed")
+	}
+	if l.TryAcquire("b.example.com") {
+		t.Errorf("acquire: expected subdomains to share the wildcard limit")
+	}
+	if !l.TryAcquire("fast.example.com") {
+		t.Errorf("acquire: expected exact policy to take precedence")
+	}
+}
+
+func TestHostLimiterDelay(t *testing.T) {
+	now := time.Now()
+	clock := &common.FakeClock{FakeTime: now}
+
+	l := NewHostLimiter([]HostPolicy{{Pattern: "example.com", Delay: time.Minute}})
+	l.Clock = clock
+
+	if !l.TryAcquire("example.com") {
+		t.Errorf("acquire: expected first request to be allowed")
+	}
+	l.Release("example.com")
+
+	if l.TryAcquire("example.com") {
+		t.Errorf("acquire: expected request within the delay to be held back")
+	}
+
+	clock.FakeTime = now.Add(time.Minute)
+	if !l.TryAcquire("example.com") {
+		t.Errorf("acquire: expected request after the delay to be allowed")
+	}
+}
+
+func TestHostLimiterForgetsIdleHosts(t *testing.T) {
+	now := time.Now()
+	clock := &common.FakeClock{FakeTime: now}
+
+	l := NewHostLimiter([]HostPolicy{{Pattern: "example.com", Delay: time.Minute}})
+	l.Clock = clock
+
+	l.TryAcquire("example.com")
+	l.Release("example.com")
+	if len(l.hosts) != 1 {
+		t.Fatalf("hosts: expected example.com kept within its delay, got %d", len(l.hosts))
+	}
+
+	clock.FakeTime = now.Add(time.Minute)
+	l.TryAcquire("other.example.net")
+	l.Release("other.example.net")
+	if len(l.hosts) != 0 {
+		t.Errorf("hosts: expected idle hosts forgotten, got %d", len(l.hosts))
+	}
+}
@@ -0,0 +1,96 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/patdowney/downloaderd-common/common"
+)
+
+// HTTPFetcher fetches http and https URLs. A nil Client means
+// http.DefaultClient, and a nil Clock the system clock.
+type HTTPFetcher struct {
+	Client *http.Client
+	Clock  common.Clock
+}
+
+func (f *HTTPFetcher) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return http.DefaultClient
+}
+
+func (f *HTTPFetcher) now() time.Time {
+	if f.Clock != nil {
+		return f.Clock.Now()
+	}
+	return time.Now()
+}
+
+// Fetch ...
+func (f *HTTPFetcher) Fetch(ctx context.Context, download *Download, offset uint64) (*Source, error) {
+	return f.FetchURL(ctx, download.URL, download.Auth, download.Metadata, offset)
+}
+
+// FetchURL requests sourceURL with auth, asking for everything after offset when it
+// is non-zero. Origins that can't honour the range, or whose content no
+// longer matches validators, send the complete body instead.
+func (f *HTTPFetcher) FetchURL(ctx context.Context, sourceURL string, auth *Auth, validators *Metadata, offset uint64) (*Source, error) {
+	res, err := f.get(ctx, sourceURL, auth, validators, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	start := uint64(0)
+	if res.StatusCode == http.StatusPartialContent {
+		start = offset
+	}
+
+	return &Source{
+		ReadCloser: res.Body,
+		Offset:     start,
+		Metadata:   MetadataFromResponse(res, f.now())}, nil
+}
+
+func (f *HTTPFetcher) get(ctx context.Context, sourceURL string, auth *Auth, validators *Metadata, offset uint64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", sourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = auth.Apply(req)
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validators.RangeValidator())
+	}
+
+	res, err := f.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res, nil
+	case http.StatusPartialContent:
+		if offset > 0 {
+			contentRange, err := ParseContentRange(res.Header.Get("Content-Range"))
+			if err == nil && contentRange.Start == offset {
+				return res, nil
+			}
+			res.Body.Close()
+			return f.get(ctx, sourceURL, auth, validators, 0)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset > 0 {
+			res.Body.Close()
+			return f.get(ctx, sourceURL, auth, validators, 0)
+		}
+	}
+	res.Body.Close()
+
+	return nil, NewHTTPError("Get", res)
+}
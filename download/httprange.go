@@ -0,0 +1,52 @@
+package download
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ContentRange ...
+type ContentRange struct {
+	Start uint64
+	End   uint64
+	// Total is -1 when the origin doesn't know the complete length
+	Total int64
+}
+
+// ParseContentRange parses a 'Content-Range: bytes start-end/total' header.
+func ParseContentRange(header string) (*ContentRange, error) {
+	const unit = "bytes "
+	if !strings.HasPrefix(header, unit) {
+		return nil, fmt.Errorf("unsupported content-range: '%s'", header)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(header, unit), "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid content-range: '%s'", header)
+	}
+
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid content-range: '%s'", header)
+	}
+
+	var err error
+	cr := &ContentRange{Total: -1}
+	cr.Start, err = strconv.ParseUint(bounds[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	cr.End, err = strconv.ParseUint(bounds[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if parts[1] != "*" {
+		cr.Total, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cr, nil
+}
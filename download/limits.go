@@ -0,0 +1,131 @@
+package download
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Limits are the server wide limits on what downloads may fetch. A zero
+// MaxSize means no limit. AllowedTypes and DeniedTypes hold MIME types
+// such as "text/html", "image/*" or "*/*"; a denied type is refused even
+// when it is also allowed, and when AllowedTypes is empty every type not
+// denied is allowed. Content of unknown type, because the source doesn't
+// report one and it couldn't be sniffed, isn't checked.
+type Limits struct {
+	MaxSize      uint64
+	AllowedTypes []string
+	DeniedTypes  []string
+}
+
+// SizeLimitError is returned when a download is larger than allowed.
+// Size is what the origin announced, or what had been read when the limit
+// was passed.
+type SizeLimitError struct {
+	Size  uint64
+	Limit uint64
+}
+
+func (e SizeLimitError) Error() string {
+	return fmt.Sprintf("size %d exceeds the limit of %d bytes", e.Size, e.Limit)
+}
+
+// ContentTypeError is returned when the origin sends a type of content
+// that isn't allowed.
+type ContentTypeError struct {
+	MimeType string
+	Reason   string
+}
+
+func (e ContentTypeError) Error() string {
+	return fmt.Sprintf("content type '%s' refused: %s", e.MimeType, e.Reason)
+}
+
+// MaxSizeFor returns the size limit for d, the smaller of the server wide
+// limit and the one requested, or zero for no limit.
+func (l *Limits) MaxSizeFor(d *Download) uint64 {
+	limit := d.MaxSize
+	if l != nil && l.MaxSize > 0 && (limit == 0 || l.MaxSize < limit) {
+		limit = l.MaxSize
+	}
+	return limit
+}
+
+func mimeTypeMatches(pattern string, mimeType string) bool {
+	if pattern == "*/*" || pattern == mimeType {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mimeType, pattern[:len(pattern)-1])
+	}
+	return false
+}
+
+func mimeTypeListed(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		if mimeTypeMatches(pattern, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// ChecksTypes reports whether the limits depend on the type of content.
+func (l *Limits) ChecksTypes() bool {
+	return l != nil && (len(l.AllowedTypes) > 0 || len(l.DeniedTypes) > 0)
+}
+
+// sniffMimeType guesses the type of content from its first bytes, for
+// sources such as ftp and file that don't report one.
+func sniffMimeType(r *bufio.Reader) string {
+	header, _ := r.Peek(512)
+	if len(header) == 0 {
+		return ""
+	}
+	return http.DetectContentType(header)
+}
+
+// Admit checks what the origin says about d's content against the limits,
+// before any of it is stored.
+func (l *Limits) Admit(d *Download, metadata *Metadata) error {
+	limit := l.MaxSizeFor(d)
+	if limit > 0 && metadata.Size > limit {
+		return SizeLimitError{Size: metadata.Size, Limit: limit}
+	}
+
+	if !l.ChecksTypes() {
+		return nil
+	}
+
+	mimeType, _, err := mime.ParseMediaType(metadata.MimeType)
+	if err != nil {
+		mimeType = ""
+	}
+	mimeType = strings.ToLower(mimeType)
+	if mimeType == "" {
+		return nil
+	}
+
+	if mimeTypeListed(l.DeniedTypes, mimeType) {
+		return ContentTypeError{MimeType: metadata.MimeType, Reason: "denied"}
+	}
+	if len(l.AllowedTypes) > 0 && !mimeTypeListed(l.AllowedTypes, mimeType) {
+		return ContentTypeError{MimeType: metadata.MimeType, Reason: "not allowed"}
+	}
+
+	return nil
+}
+
+// ParseMimeTypes splits a comma separated list of MIME types.
+func ParseMimeTypes(value string) []string {
+	var mimeTypes []string
+	for _, mimeType := range strings.Split(value, ",") {
+		mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+		if mimeType != "" {
+			mimeTypes = append(mimeTypes, mimeType)
+		}
+	}
+	return mimeTypes
+}
@@ -0,0 +1,106 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLimitsAdmit(t *testing.T) {
+	l := &Limits{
+		MaxSize:      100,
+		AllowedTypes: ParseMimeTypes("application/*, text/csv"),
+		DeniedTypes:  ParseMimeTypes("application/x-msdownload")}
+
+	tests := []struct {
+		download *Download
+		metadata *Metadata
+		ok       bool
+	}{
+		{&Download{}, &Metadata{Size: 50, MimeType: "application/zip"}, true},
+		{&Download{}, &Metadata{Size: 50, MimeType: "text/csv; charset=utf-8"}, true},
+		{&Download{}, &Metadata{Size: 150, MimeType: "application/zip"}, false},
+		{&Download{MaxSize: 40}, &Metadata{Size: 50, MimeType: "application/zip"}, false},
+		{&Download{}, &Metadata{Size: 50, MimeType: "text/html"}, false},
+		{&Download{}, &Metadata{Size: 50, MimeType: "application/x-msdownload"}, false},
+		// nothing to check when the source doesn't report a type
+		{&Download{}, &Metadata{Size: 50}, true},
+	}
+	for _, test := range tests {
+		err := l.Admit(test.download, test.metadata)
+		if test.ok && err != nil {
+			t.Errorf("admit(%v): expected admitted, got %v", test.metadata, err)
+		}
+		if !test.ok && ErrorKind(err) != ErrorKindRejected {
+			t.Errorf("admit(%v): expected rejected, got %v", test.metadata, err)
+		}
+	}
+}
+
+func TestSaveSniffsMissingContentType(t *testing.T) {
+	tests := []struct {
+		content string
+		ok      bool
+	}{
+		{"PK\x03\x04" + testContent, true},
+		{"<html><body>" + testContent, false},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			// as ftp and file sources do, say nothing of the type
+			rw.Header()["Content-Type"] = nil
+			rw.Write([]byte(test.content))
+		}))
+
+		sender := &RecordingStatusSender{}
+		w := createTestWorker(&MemoryFileStore{}, sender)
+		w.Limits = &Limits{AllowedTypes: ParseMimeTypes("application/*")}
+
+		d := &Download{
+			ID:           "some-dummy-downloadid",
+			URL:          server.URL,
+			ChecksumType: "sha256",
+			Metadata:     &Metadata{},
+			Status:       &Status{}}
+		err := w.SaveWithStatus(context.Background(), d)
+		server.Close()
+
+		if test.ok && err != nil {
+			t.Errorf("save(%.12q): expected admitted, got %v", test.content, err)
+		}
+		if !test.ok && ErrorKind(err) != ErrorKindRejected {
+			t.Errorf("save(%.12q): expected rejected, got %v", test.content, err)
+		}
+	}
+}
+
+func TestSaveStopsAtMaxSize(t *testing.T) {
+	// no Content-Length, so the limit can only be noticed while streaming
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(testContent[:20]))
+		rw.(http.Flusher).Flush()
+		rw.Write([]byte(testContent[20:]))
+	}))
+	defer server.Close()
+
+	fileStore := &MemoryFileStore{}
+	sender := &RecordingStatusSender{}
+	w := createTestWorker(fileStore, sender)
+
+	err := w.SaveWithStatus(context.Background(), &Download{
+		ID:           "some-dummy-downloadid",
+		URL:          server.URL,
+		ChecksumType: "sha256",
+		MaxSize:      25,
+		Status:       &Status{}})
+
+	var sizeErr SizeLimitError
+	if !errors.As(err, &sizeErr) || sizeErr.Limit != 25 {
+		t.Errorf("error: expected size limit of %d, got %v", 25, err)
+	}
+	if sender.Last().State != StateFailed {
+		t.Errorf("state: expected %s, got %s", StateFailed, sender.Last().State)
+	}
+}
@@ -3,6 +3,7 @@ package download
 import (
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,15 +19,20 @@ type Metadata struct {
 	ETag         string
 	Expires      time.Time
 	StatusCode   int
+	Headers      map[string][]string
+	// FinalURL is where the data came from after following Redirects.
+	FinalURL  string
+	Redirects []Redirect
 
 	Errors []string
 }
 
-func GetMetadataFromHead(requestTime time.Time, request *Request) (*Metadata, error) {
-	res, err := http.Head(request.URL)
+func GetMetadataFromHead(client *http.Client, requestTime time.Time, request *Request) (*Metadata, error) {
+	res, err := client.Head(request.URL)
 	if err != nil {
 		return nil, err
 	}
+	res.Body.Close()
 	metadata := NewMetadata(request, res, requestTime)
 
 	return metadata, nil
@@ -37,33 +43,110 @@ func ParseTime(timeHeader string) (time.Time, error) {
 }
 
 func NewMetadata(request *Request, res *http.Response, requestTime time.Time) *Metadata {
+	m := MetadataFromResponse(res, requestTime)
+	m.RequestID = request.ID
 
+	return m
+}
+
+// MetadataFromResponse reads what the origin said about the resource from
+// the response headers. Size is the length of the whole resource, even
+// when the response only carries part of it.
+func MetadataFromResponse(res *http.Response, requestTime time.Time) *Metadata {
 	m := &Metadata{
-		RequestID:     request.ID,
 		TimeRequested: requestTime,
 		MimeType:      res.Header.Get("Content-Type"),
 		ETag:          res.Header.Get("ETag"),
 		Server:        res.Header.Get("Server"),
 		StatusCode:    res.StatusCode,
+		Headers:       make(map[string][]string, len(res.Header)),
 		Errors:        make([]string, 0)}
 
+	for name, values := range res.Header {
+		m.Headers[name] = values
+	}
+
+	if res.Request != nil {
+		m.FinalURL = res.Request.URL.String()
+		m.Redirects = RedirectsFromResponse(res)
+	}
+
 	var err error
-	// reference time: Mon Jan 2 15:04:05 -0700 MST 2006
-	contentLengthHeader := res.Header.Get("Content-Length")
-	m.Size, err = strconv.ParseUint(contentLengthHeader, 10, 64)
+	if res.StatusCode == http.StatusPartialContent {
+		var contentRange *ContentRange
+		contentRange, err = ParseContentRange(res.Header.Get("Content-Range"))
+		if err == nil && contentRange.Total >= 0 {
+			m.Size = uint64(contentRange.Total)
+		}
+	} else if contentLengthHeader := res.Header.Get("Content-Length"); contentLengthHeader != "" {
+		m.Size, err = strconv.ParseUint(contentLengthHeader, 10, 64)
+	}
 	if err != nil {
 		m.Errors = append(m.Errors, err.Error())
 	}
 
-	m.LastModified, err = ParseTime(res.Header.Get("Last-Modified"))
-	if err != nil {
-		m.Errors = append(m.Errors, err.Error())
+	// reference time: Mon Jan 2 15:04:05 -0700 MST 2006
+	if lastModified := res.Header.Get("Last-Modified"); lastModified != "" {
+		m.LastModified, err = ParseTime(lastModified)
+		if err != nil {
+			m.Errors = append(m.Errors, err.Error())
+		}
 	}
 
-	m.Expires, err = ParseTime(res.Header.Get("Expires"))
-	if err != nil {
-		m.Errors = append(m.Errors, err.Error())
+	if expires := res.Header.Get("Expires"); expires != "" {
+		m.Expires, err = ParseTime(expires)
+		if err != nil {
+			m.Errors = append(m.Errors, err.Error())
+		}
 	}
 
 	return m
 }
+
+// Update copies in everything other knows about the resource, leaving
+// fields it doesn't know alone.
+func (m *Metadata) Update(other *Metadata) {
+	if other.MimeType != "" {
+		m.MimeType = other.MimeType
+	}
+	if other.Size != 0 {
+		m.Size = other.Size
+	}
+	if other.Server != "" {
+		m.Server = other.Server
+	}
+	if other.ETag != "" {
+		m.ETag = other.ETag
+	}
+	if !other.LastModified.IsZero() {
+		m.LastModified = other.LastModified
+	}
+	if !other.Expires.IsZero() {
+		m.Expires = other.Expires
+	}
+	if other.StatusCode != 0 {
+		m.StatusCode = other.StatusCode
+	}
+	if other.Headers != nil {
+		m.Headers = other.Headers
+	}
+	if other.FinalURL != "" {
+		m.FinalURL = other.FinalURL
+		m.Redirects = other.Redirects
+	}
+	if len(other.Errors) > 0 {
+		m.Errors = append(m.Errors, other.Errors...)
+	}
+}
+
+// RangeValidator returns the value to send as If-Range when resuming, or
+// an empty string if there's nothing strong enough to compare against.
+func (m *Metadata) RangeValidator() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	if !m.LastModified.IsZero() {
+		return m.LastModified.UTC().Format(http.TimeFormat)
+	}
+	return ""
+}
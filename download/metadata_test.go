@@ -0,0 +1,80 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMetadataFromResponse(t *testing.T) {
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":   {"text/plain"},
+			"Content-Length": {"36"},
+			"Etag":           {`"v1"`},
+			"Last-Modified":  {"Mon, 02 Jan 2006 15:04:05 GMT"},
+			"X-Custom":       {"some-value"}}}
+
+	m := MetadataFromResponse(res, time.Now())
+
+	if m.MimeType != "text/plain" || m.Size != 36 || m.ETag != `"v1"` {
+		t.Errorf("metadata: expected text/plain, 36, \"v1\", got %s, %d, %s", m.MimeType, m.Size, m.ETag)
+	}
+	if m.LastModified.IsZero() {
+		t.Errorf("last-modified: expected a time")
+	}
+	if m.Headers["X-Custom"][0] != "some-value" {
+		t.Errorf("headers: expected X-Custom to be kept, got %v", m.Headers)
+	}
+	if len(m.Errors) != 0 {
+		t.Errorf("errors: expected none, got %v", m.Errors)
+	}
+}
+
+func TestMetadataFromPartialResponse(t *testing.T) {
+	res := &http.Response{
+		StatusCode: http.StatusPartialContent,
+		Header: http.Header{
+			"Content-Length": {"26"},
+			"Content-Range":  {"bytes 10-35/36"}}}
+
+	m := MetadataFromResponse(res, time.Now())
+	if m.Size != 36 {
+		t.Errorf("size: expected %d, got %d", 36, m.Size)
+	}
+}
+
+func TestSaveRecordsMetadata(t *testing.T) {
+	var rangeHeader string
+	server := serveTestContent(`"v1"`, &rangeHeader)
+	defer server.Close()
+
+	sender := &RecordingStatusSender{}
+	w := createTestWorker(&MemoryFileStore{}, sender)
+	w.Preflight = true
+
+	d := &Download{
+		ID:           "some-dummy-downloadid",
+		URL:          server.URL,
+		ChecksumType: "sha256",
+		Metadata:     &Metadata{},
+		Status:       &Status{}}
+	w.SaveWithStatus(context.Background(), d)
+
+	stored := &Download{ID: d.ID, Metadata: &Metadata{}, Status: &Status{}}
+	for i := range sender.Updates {
+		stored.AddStatusUpdate(&sender.Updates[i])
+	}
+
+	if stored.Metadata.Size != uint64(len(testContent)) {
+		t.Errorf("size: expected %d, got %d", len(testContent), stored.Metadata.Size)
+	}
+	if stored.Metadata.ETag != `"v1"` {
+		t.Errorf("etag: expected %s, got %s", `"v1"`, stored.Metadata.ETag)
+	}
+	if stored.PercentComplete() != 100 {
+		t.Errorf("percent-complete: expected %d, got %f", 100, stored.PercentComplete())
+	}
+}
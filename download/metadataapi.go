@@ -13,7 +13,8 @@ func ToAPIMetadata(dm *Metadata) *api.Metadata {
 		LastModified:  dm.LastModified,
 		ETag:          dm.ETag,
 		Expires:       dm.Expires,
-		StatusCode:    dm.StatusCode}
+		StatusCode:    dm.StatusCode,
+		Headers:       dm.Headers}
 
 	return m
 }
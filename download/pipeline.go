@@ -0,0 +1,318 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/patdowney/downloaderd-common/common"
+)
+
+// ErrNoArtifacts is returned when a stage produces files but the file
+// store can't keep them.
+var ErrNoArtifacts = errors.New("the file store can't keep artifacts")
+
+// ArtifactStore is implemented by file stores that can keep the files
+// produced by processing stages alongside a download's data.
+type ArtifactStore interface {
+	GetArtifactWriter(d *Download, name string) (io.WriteCloser, error)
+	GetArtifactReader(d *Download, name string) (io.ReadCloser, error)
+	DeleteArtifacts(d *Download) error
+}
+
+// LocalFileStore is implemented by file stores that keep data on the local
+// disk, so stages can read it where it is rather than from a copy.
+type LocalFileStore interface {
+	LocalPath(*Download) (string, error)
+}
+
+// Artifact is a file a stage produced, kept with the download under Name.
+type Artifact struct {
+	Name     string
+	Size     uint64
+	Checksum string
+}
+
+// StageResult records how a stage went. Error is empty if it succeeded.
+type StageResult struct {
+	Stage       string
+	TimeStarted time.Time
+	Duration    time.Duration
+	Error       string
+	Artifacts   []Artifact
+	// Scan is the verdict of a scanning stage.
+	Scan *ScanResult
+}
+
+// Succeeded ...
+func (r *StageResult) Succeeded() bool {
+	return r.Error == ""
+}
+
+// Artifact returns the artifact named name, or nil if no stage of the
+// download produced one.
+func (d *Download) Artifact(name string) *Artifact {
+	for i := range d.Stages {
+		for j := range d.Stages[i].Artifacts {
+			if d.Stages[i].Artifacts[j].Name == name {
+				return &d.Stages[i].Artifacts[j]
+			}
+		}
+	}
+	return nil
+}
+
+// StageError is returned when a stage fails, stopping the pipeline.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e StageError) Error() string {
+	return fmt.Sprintf("%s stage failed: %v", e.Stage, e.Err)
+}
+
+func (e StageError) Unwrap() error {
+	return e.Err
+}
+
+// StageRun is what a stage works on.
+type StageRun struct {
+	Download *Download
+	// Input is a local file holding the data as left by the previous
+	// stage. Stages must not change it, but may point it at a new file
+	// for the stages after them.
+	Input string
+	// Name is the file name of Input as the origin would call it.
+	Name string
+	// Dir is an empty directory for the stage's output. Every file left
+	// in it is kept as an artifact of the download.
+	Dir string
+	// Scan is set by stages that scan the data for malware.
+	Scan *ScanResult
+}
+
+// Stage is one step of a Pipeline.
+type Stage interface {
+	Name() string
+	Run(ctx context.Context, run *StageRun) error
+}
+
+// Pipeline runs its stages in order over a download's data once it has
+// been fetched and its checksum verified, before hooks are notified. The
+// first stage to fail stops the pipeline and fails the download.
+type Pipeline struct {
+	Stages []Stage
+	// WorkDir holds the scratch directories stages work in. Empty means
+	// the system temporary directory.
+	WorkDir string
+}
+
+// Enabled reports whether there are any stages to run.
+func (p *Pipeline) Enabled() bool {
+	return p != nil && len(p.Stages) > 0
+}
+
+// Run runs the stages over d's data, storing what they produce in
+// fileStore, and returns the result of each stage that ran.
+func (p *Pipeline) Run(ctx context.Context, d *Download, fileStore FileStore, clock common.Clock) ([]StageResult, error) {
+	if !p.Enabled() {
+		return nil, nil
+	}
+
+	workDir, err := ioutil.TempDir(p.WorkDir, "pipeline-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	// anything left by an earlier run that didn't finish
+	if store, ok := fileStore.(ArtifactStore); ok {
+		err = store.DeleteArtifacts(d)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	input, err := localCopy(d, fileStore, workDir)
+	if err != nil {
+		return nil, err
+	}
+	run := &StageRun{Download: d, Input: input, Name: sourceName(d.URL)}
+
+	results := make([]StageResult, 0, len(p.Stages))
+	for i, stage := range p.Stages {
+		result := StageResult{Stage: stage.Name(), TimeStarted: clock.Now()}
+
+		run.Dir = filepath.Join(workDir, fmt.Sprintf("%d-%s", i, stage.Name()))
+		err = os.Mkdir(run.Dir, 0755)
+		if err == nil {
+			err = stage.Run(ctx, run)
+		}
+		result.Scan, run.Scan = run.Scan, nil
+		if err == nil {
+			result.Artifacts, err = storeArtifacts(d, fileStore, stage.Name(), run.Dir)
+		}
+
+		result.Duration = clock.Now().Sub(result.TimeStarted)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			return results, StageError{Stage: stage.Name(), Err: err}
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// localCopy returns the path of d's data on the local disk, copying it
+// into dir if the file store keeps it elsewhere.
+func localCopy(d *Download, fileStore FileStore, dir string) (string, error) {
+	if local, ok := fileStore.(LocalFileStore); ok {
+		return local.LocalPath(d)
+	}
+
+	reader, err := fileStore.GetReader(d)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	copyPath := filepath.Join(dir, "data")
+	f, err := os.Create(copyPath)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, reader)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return copyPath, err
+}
+
+// sourceName is the file name at the end of sourceURL's path.
+func sourceName(sourceURL string) string {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return "data"
+	}
+
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "data"
+	}
+	return name
+}
+
+// storeArtifacts keeps every file in dir as an artifact named after the
+// stage and its path within dir.
+func storeArtifacts(d *Download, fileStore FileStore, stageName string, dir string) ([]Artifact, error) {
+	var artifacts []Artifact
+
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		store, ok := fileStore.(ArtifactStore)
+		if !ok {
+			return ErrNoArtifacts
+		}
+
+		relative, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		name := stageName + "/" + filepath.ToSlash(relative)
+
+		artifact, err := storeArtifact(d, store, name, filePath)
+		if err != nil {
+			return err
+		}
+		artifacts = append(artifacts, artifact)
+
+		return nil
+	})
+
+	return artifacts, err
+}
+
+func storeArtifact(d *Download, store ArtifactStore, name string, filePath string) (Artifact, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return Artifact{}, err
+	}
+	defer f.Close()
+
+	writer, err := store.GetArtifactWriter(d, name)
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(writer, hash), f)
+	closeErr := writer.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return Artifact{Name: name, Size: uint64(size), Checksum: hex.EncodeToString(hash.Sum(nil))}, err
+}
+
+// ParseStage reads a stage written as extract, decompress,
+// checksum[=type,type], command=path [args] or scan=scanner, where scanner
+// is as read by ParseScanner.
+func ParseStage(value string) (Stage, error) {
+	parts := strings.SplitN(value, "=", 2)
+	argument := ""
+	if len(parts) == 2 {
+		argument = strings.TrimSpace(parts[1])
+	}
+
+	switch parts[0] {
+	case "extract":
+		return &ExtractStage{MaxBytes: DefaultMaxExpandedSize, MaxFiles: DefaultMaxExtractedFiles}, nil
+	case "decompress":
+		return &DecompressStage{MaxBytes: DefaultMaxExpandedSize}, nil
+	case "checksum":
+		var types []string
+		for _, checksumType := range strings.Split(argument, ",") {
+			checksumType = strings.ToLower(strings.TrimSpace(checksumType))
+			if checksumType == "" {
+				continue
+			}
+			if !SupportedChecksumType(checksumType) {
+				return nil, fmt.Errorf("stage %q: unsupported checksum type: '%s'", value, checksumType)
+			}
+			types = append(types, checksumType)
+		}
+		return &ChecksumStage{Types: types}, nil
+	case "scan":
+		scanner, err := ParseScanner(argument)
+		if err != nil {
+			return nil, fmt.Errorf("stage %q: %v", value, err)
+		}
+		return &ScanStage{Scanner: scanner, Timeout: DefaultScanTimeout}, nil
+	case "command":
+		fields := strings.Fields(argument)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("stage %q: expected command=path [args]", value)
+		}
+		return &CommandStage{Path: fields[0], Args: fields[1:], Timeout: DefaultCommandTimeout}, nil
+	}
+
+	return nil, fmt.Errorf("unknown stage: '%s'", parts[0])
+}
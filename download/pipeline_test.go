@@ -0,0 +1,170 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patdowney/downloaderd-common/common"
+)
+
+type memoryArtifactStore struct {
+	MemoryFileStore
+	Artifacts map[string][]byte
+}
+
+type memoryArtifactWriter struct {
+	bytes.Buffer
+	store *memoryArtifactStore
+	name  string
+}
+
+func (w *memoryArtifactWriter) Close() error {
+	w.store.Artifacts[w.name] = w.Bytes()
+	return nil
+}
+
+func (s *memoryArtifactStore) GetArtifactWriter(d *Download, name string) (io.WriteCloser, error) {
+	return &memoryArtifactWriter{store: s, name: name}, nil
+}
+
+func (s *memoryArtifactStore) GetArtifactReader(d *Download, name string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(s.Artifacts[name])), nil
+}
+
+func (s *memoryArtifactStore) DeleteArtifacts(d *Download) error {
+	s.Artifacts = make(map[string][]byte)
+	return nil
+}
+
+func tarGzip(t *testing.T, name string, content string) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	if err == nil {
+		_, err = tarWriter.Write([]byte(content))
+	}
+	if err == nil {
+		err = tarWriter.Close()
+	}
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestPipelineRun(t *testing.T) {
+	store := &memoryArtifactStore{}
+	store.Data = tarGzip(t, "docs/readme.txt", testContent)
+
+	pipeline := &Pipeline{Stages: []Stage{
+		&DecompressStage{},
+		&ExtractStage{},
+		&ChecksumStage{Types: []string{"sha256"}}}}
+	d := &Download{ID: "some-dummy-downloadid", URL: "http://example.com/files/bundle.tar.gz", ChecksumType: "sha256"}
+
+	results, err := pipeline.Run(context.Background(), d, store, &common.RealClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("results: expected 3, got %v", results)
+	}
+
+	d.Stages = results
+	if d.Artifact("decompress/bundle.tar") == nil {
+		t.Errorf("decompress: expected bundle.tar, got %v", results[0].Artifacts)
+	}
+	if string(store.Artifacts["extract/docs/readme.txt"]) != testContent {
+		t.Errorf("extract: expected %q, got %q", testContent, store.Artifacts["extract/docs/readme.txt"])
+	}
+	sidecar := string(store.Artifacts["checksum/bundle.tar.sha256"])
+	if !strings.HasSuffix(sidecar, "  bundle.tar\n") {
+		t.Errorf("checksum: unexpected sidecar %q", sidecar)
+	}
+}
+
+func TestExtractRefusesEscapingEntries(t *testing.T) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	w, _ := zipWriter.Create("../../escaped.txt")
+	w.Write([]byte(testContent))
+	zipWriter.Close()
+
+	store := &memoryArtifactStore{}
+	store.Data = buf.Bytes()
+
+	pipeline := &Pipeline{Stages: []Stage{&ExtractStage{}}}
+	d := &Download{ID: "some-dummy-downloadid", URL: "http://example.com/archive.zip"}
+
+	results, err := pipeline.Run(context.Background(), d, store, &common.RealClock{})
+	var stageErr StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != "extract" {
+		t.Fatalf("error: expected extract stage error, got %v", err)
+	}
+	if len(results) != 1 || results[0].Succeeded() {
+		t.Errorf("results: expected a failed extract, got %v", results)
+	}
+}
+
+func TestSaveRunsPipeline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader(testContent))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		script string
+		state  State
+	}{
+		{`cp "$DOWNLOAD_FILE" copy`, StateSucceeded},
+		{`echo broken >&2; exit 3`, StateFailed},
+	}
+	for _, test := range tests {
+		store := &memoryArtifactStore{}
+		sender := &RecordingStatusSender{}
+		w := createTestWorker(store, sender)
+		w.Pipeline = &Pipeline{Stages: []Stage{&CommandStage{Path: "sh", Args: []string{"-c", test.script}}}}
+
+		w.SaveWithStatus(context.Background(), &Download{
+			ID:           "some-dummy-downloadid",
+			URL:          server.URL + "/file",
+			ChecksumType: "sha256",
+			Status:       &Status{}})
+
+		last := sender.Last()
+		if last.State != test.state {
+			t.Errorf("%s: expected %s, got %s", test.script, test.state, last.State)
+		}
+		if len(last.Stages) != 1 {
+			t.Fatalf("%s: expected one stage, got %v", test.script, last.Stages)
+		}
+
+		if test.state == StateSucceeded {
+			if string(store.Artifacts["command/copy"]) != testContent {
+				t.Errorf("%s: expected a copy of the data, got %q", test.script, store.Artifacts["command/copy"])
+			}
+		} else {
+			e := <-w.ErrorChannel
+			if e.Kind != ErrorKindProcessing || !strings.Contains(e.OriginalError, "broken") {
+				t.Errorf("%s: expected the command's output in a processing error, got %v", test.script, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package download
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyRule sends requests for hosts matching Pattern through Proxy, or
+// directly when Proxy is nil. Pattern is either a host name or a wildcard
+// such as "*.example.com".
+type ProxyRule struct {
+	Pattern string
+	Proxy   *url.URL
+}
+
+// ParseProxyRule reads a rule written as pattern=proxy or pattern=direct,
+// e.g. "*.internal.example.com=direct".
+func ParseProxyRule(value string) (ProxyRule, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return ProxyRule{}, fmt.Errorf("proxy rule %q: expected pattern=proxy or pattern=direct", value)
+	}
+	rule := ProxyRule{Pattern: strings.ToLower(parts[0])}
+
+	if parts[1] != "direct" {
+		proxy, err := ParseProxyURL(parts[1])
+		if err != nil {
+			return ProxyRule{}, fmt.Errorf("proxy rule %q: %v", value, err)
+		}
+		rule.Proxy = proxy
+	}
+
+	return rule, nil
+}
+
+// ParseProxyURL reads the address of an http, https or socks5 proxy.
+func ParseProxyURL(value string) (*url.URL, error) {
+	proxy, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: '%s'", proxy.Scheme)
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", value)
+	}
+
+	return proxy, nil
+}
+
+// ParseNoProxy splits a NO_PROXY style list of hosts, domains, IP
+// addresses and CIDR ranges.
+func ParseNoProxy(value string) []string {
+	var noProxy []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" {
+			noProxy = append(noProxy, entry)
+		}
+	}
+	return noProxy
+}
+
+// ProxyConfig chooses the proxy for each outbound request. A matching
+// Rule is used first, then hosts listed in NoProxy go direct, and
+// everything else goes through Default. A nil Default means direct.
+type ProxyConfig struct {
+	Default *url.URL
+	NoProxy []string
+	Rules   []ProxyRule
+}
+
+func (c *ProxyConfig) ruleFor(host string) *ProxyRule {
+	i := bestHostMatch(host, len(c.Rules), func(i int) string {
+		return c.Rules[i].Pattern
+	})
+	if i < 0 {
+		return nil
+	}
+	return &c.Rules[i]
+}
+
+func (c *ProxyConfig) bypass(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	ip := net.ParseIP(host)
+
+	for _, entry := range c.NoProxy {
+		if entry == "*" {
+			return true
+		}
+
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err == nil && ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port(u) {
+			continue
+		}
+
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		domain := strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func port(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Port()
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// ProxyFor returns the proxy requests for u go through, or nil if they go
+// direct.
+func (c *ProxyConfig) ProxyFor(u *url.URL) *url.URL {
+	if c == nil {
+		return nil
+	}
+
+	rule := c.ruleFor(strings.ToLower(u.Hostname()))
+	if rule != nil {
+		return rule.Proxy
+	}
+	if c.bypass(u) {
+		return nil
+	}
+	return c.Default
+}
+
+// Proxy is for use as http.Transport's Proxy.
+func (c *ProxyConfig) Proxy(req *http.Request) (*url.URL, error) {
+	return c.ProxyFor(req.URL), nil
+}
+
+// Describe names the proxy requests for rawURL go through without any
+// credentials in its address, or returns "" if they go direct.
+func (c *ProxyConfig) Describe(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	proxy := c.ProxyFor(u)
+	if proxy == nil {
+		return ""
+	}
+	return proxy.Redacted()
+}
@@ -0,0 +1,83 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestProxyFor(t *testing.T) {
+	egress := mustParseURL(t, "http://egress.example.com:3128")
+	socks := mustParseURL(t, "socks5://socks.example.com:1080")
+
+	direct, _ := ParseProxyRule("*.internal.example.com=direct")
+	viaSocks, _ := ParseProxyRule("*.example.org=socks5://socks.example.com:1080")
+	c := &ProxyConfig{
+		Default: egress,
+		NoProxy: ParseNoProxy("localhost, .corp.example.com, 10.0.0.0/8"),
+		Rules:   []ProxyRule{direct, viaSocks}}
+
+	tests := []struct {
+		url      string
+		expected *url.URL
+	}{
+		{"http://files.example.com/a", egress},
+		{"http://db.internal.example.com/a", nil},
+		{"https://cdn.example.org/a", socks},
+		{"http://localhost:8080/a", nil},
+		{"http://build.corp.example.com/a", nil},
+		{"http://10.1.2.3/a", nil},
+		{"http://192.168.1.1/a", egress},
+	}
+	for _, test := range tests {
+		proxy := c.ProxyFor(mustParseURL(t, test.url))
+		if (proxy == nil) != (test.expected == nil) || (proxy != nil && *proxy != *test.expected) {
+			t.Errorf("proxy(%s): expected %v, got %v", test.url, test.expected, proxy)
+		}
+	}
+}
+
+func TestSaveRecordsProxy(t *testing.T) {
+	var requestedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requestedHost = req.URL.Host
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader(testContent))
+	}))
+	defer proxy.Close()
+
+	proxies := &ProxyConfig{Default: mustParseURL(t, proxy.URL)}
+	fileStore := &MemoryFileStore{}
+	sender := &RecordingStatusSender{}
+	w := createTestWorker(fileStore, sender)
+	w.HTTPClient = NewHTTPClient(&Transport{Proxies: proxies}, nil)
+	w.Proxies = proxies
+	w.Fetchers = DefaultFetchers(w.HTTPClient, w.Clock)
+
+	w.SaveWithStatus(context.Background(), &Download{
+		ID:           "some-dummy-downloadid",
+		URL:          "http://origin.example.com/file",
+		ChecksumType: "sha256",
+		Status:       &Status{}})
+
+	if requestedHost != "origin.example.com" {
+		t.Errorf("host: expected %s, got %s", "origin.example.com", requestedHost)
+	}
+	if sender.Started().Proxy != proxy.URL {
+		t.Errorf("proxy: expected %s, got %s", proxy.URL, sender.Started().Proxy)
+	}
+	if string(fileStore.Data) != testContent {
+		t.Errorf("data: expected %s, got %s", testContent, fileStore.Data)
+	}
+}
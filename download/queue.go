@@ -0,0 +1,78 @@
+package download
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrQueueFull is returned when a download can't be accepted because the
+// queue already holds QueueLength downloads.
+var ErrQueueFull = errors.New("download queue is full")
+
+// ErrNotQueued is returned when a download that isn't waiting for a worker
+// is asked to change its place in the queue.
+var ErrNotQueued = errors.New("download is not queued")
+
+// QueueItem ...
+type QueueItem struct {
+	DownloadID string
+	Host       string
+	Priority   int
+	TimeQueued time.Time
+}
+
+// ClaimFunc is offered queued items in order until it accepts one.
+// Accepting an item takes whatever it needs to start, such as a host
+// connection slot.
+type ClaimFunc func(QueueItem) bool
+
+// Queue holds downloads waiting for a worker. Pop hands out the highest
+// priority item first, and the oldest among items of equal priority.
+type Queue interface {
+	// Push adds the item, or updates it if the download is already queued.
+	Push(QueueItem) error
+	// Pop blocks until an item is claimed and removes it.
+	Pop(ClaimFunc) (QueueItem, error)
+	// Wake makes blocked Pop calls offer their items again.
+	Wake()
+	Remove(string) (bool, error)
+	SetPriority(string, int) (bool, error)
+	List() ([]QueueItem, error)
+	Len() int
+}
+
+// Before reports whether i should be handed to a worker ahead of other.
+func (i QueueItem) Before(other QueueItem) bool {
+	if i.Priority != other.Priority {
+		return i.Priority > other.Priority
+	}
+	return i.TimeQueued.Before(other.TimeQueued)
+}
+
+// SortQueueItems orders items the way workers take them.
+func SortQueueItems(items []QueueItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Before(items[j])
+	})
+}
+
+// NextQueueItem offers items to claim in the order workers take them and
+// returns the index of the one accepted, or -1 if none was. A nil claim
+// accepts the first item.
+func NextQueueItem(items []QueueItem, claim ClaimFunc) int {
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return items[order[i]].Before(items[order[j]])
+	})
+
+	for _, i := range order {
+		if claim == nil || claim(items[i]) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,56 @@
+package download
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextQueueItemPrefersPriority(t *testing.T) {
+	now := time.Now()
+	items := []QueueItem{
+		{DownloadID: "low", Priority: 0, TimeQueued: now},
+		{DownloadID: "high", Priority: 5, TimeQueued: now.Add(time.Minute)},
+		{DownloadID: "negative", Priority: -1, TimeQueued: now.Add(-time.Minute)}}
+
+	next := NextQueueItem(items, nil)
+	if items[next].DownloadID != "high" {
+		t.Errorf("next: expected %s, got %s", "high", items[next].DownloadID)
+	}
+}
+
+func TestNextQueueItemIsFIFOWithinPriority(t *testing.T) {
+	now := time.Now()
+	items := []QueueItem{
+		{DownloadID: "second", Priority: 1, TimeQueued: now.Add(time.Second)},
+		{DownloadID: "first", Priority: 1, TimeQueued: now}}
+
+	next := NextQueueItem(items, nil)
+	if items[next].DownloadID != "first" {
+		t.Errorf("next: expected %s, got %s", "first", items[next].DownloadID)
+	}
+}
+
+func TestNextQueueItemEmpty(t *testing.T) {
+	if next := NextQueueItem(nil, nil); next != -1 {
+		t.Errorf("next: expected %d, got %d", -1, next)
+	}
+}
+
+func TestNextQueueItemSkipsUnclaimed(t *testing.T) {
+	now := time.Now()
+	items := []QueueItem{
+		{DownloadID: "busy", Host: "busy.example.com", Priority: 5, TimeQueued: now},
+		{DownloadID: "idle", Host: "idle.example.com", Priority: 0, TimeQueued: now}}
+
+	next := NextQueueItem(items, func(item QueueItem) bool {
+		return item.Host != "busy.example.com"
+	})
+	if next < 0 || items[next].DownloadID != "idle" {
+		t.Errorf("next: expected %s, got index %d", "idle", next)
+	}
+
+	next = NextQueueItem(items, func(item QueueItem) bool { return false })
+	if next != -1 {
+		t.Errorf("next: expected %d, got %d", -1, next)
+	}
+}
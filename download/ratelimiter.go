@@ -0,0 +1,179 @@
+package download
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by every read it throttles. It
+// holds at most one second of tokens, so an idle limiter allows a burst of
+// that size. A zero rate means no limit.
+type RateLimiter struct {
+	sync.Mutex
+	bytesPerSecond uint64
+	tokens         float64
+	last           time.Time
+	// filled counts every token added to the bucket, so each waiter can
+	// tell when its share of the debt has been paid off.
+	filled float64
+	// changed is closed when the rate changes, so waiters work out their
+	// delay again.
+	changed chan struct{}
+}
+
+// NewRateLimiter ...
+func NewRateLimiter(bytesPerSecond uint64) *RateLimiter {
+	return &RateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// Rate ...
+func (l *RateLimiter) Rate() uint64 {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.bytesPerSecond
+}
+
+// SetRate changes the limit, including for reads already waiting.
+func (l *RateLimiter) SetRate(bytesPerSecond uint64) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.bytesPerSecond = bytesPerSecond
+	if l.tokens > float64(bytesPerSecond) {
+		l.tokens = float64(bytesPerSecond)
+	}
+
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// refill adds the tokens earned since the last read. Callers hold the
+// lock.
+func (l *RateLimiter) refill(now time.Time) {
+	rate := float64(l.bytesPerSecond)
+
+	if l.last.IsZero() {
+		l.tokens = rate
+	} else if l.tokens < rate {
+		earned := now.Sub(l.last).Seconds() * rate
+		if l.tokens+earned > rate {
+			earned = rate - l.tokens
+		}
+		l.tokens += earned
+		l.filled += earned
+	}
+	l.last = now
+}
+
+// pending returns how long until filled reaches target at the current
+// rate, along with a channel closed if the rate changes. Callers hold the
+// lock.
+func (l *RateLimiter) pending(target float64) (time.Duration, <-chan struct{}) {
+	if l.bytesPerSecond == 0 || l.filled >= target {
+		return 0, nil
+	}
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+
+	delay := (target - l.filled) / float64(l.bytesPerSecond) * float64(time.Second)
+	return time.Duration(delay), l.changed
+}
+
+// reserve takes n tokens and returns how long to wait before they are
+// covered, along with the value of filled at which they are. The bucket
+// can go into debt, which later reads pay off.
+func (l *RateLimiter) reserve(n int, now time.Time) (time.Duration, float64, <-chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.bytesPerSecond == 0 {
+		return 0, 0, nil
+	}
+
+	l.refill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, 0, nil
+	}
+
+	target := l.filled - l.tokens
+	delay, changed := l.pending(target)
+	return delay, target, changed
+}
+
+// recheck works out the remaining delay for target after the rate changed.
+func (l *RateLimiter) recheck(target float64, now time.Time) (time.Duration, <-chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.bytesPerSecond == 0 {
+		return 0, nil
+	}
+
+	l.refill(now)
+	return l.pending(target)
+}
+
+// Wait blocks until n bytes are allowed through, or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	delay, target, changed := l.reserve(n, time.Now())
+	for delay > 0 {
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+			timer.Stop()
+			delay, changed = l.recheck(target, time.Now())
+		}
+	}
+
+	return nil
+}
+
+// ThrottledReader holds back reads until every limiter allows them.
+type ThrottledReader struct {
+	Reader   io.Reader
+	Context  context.Context
+	Limiters []*RateLimiter
+}
+
+func (r *ThrottledReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+
+	for _, l := range r.Limiters {
+		waitErr := l.Wait(r.Context, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+type downloadLimiterKey struct{}
+
+// withDownloadLimiter attaches the limiter for a single download's reads
+// to ctx, so every segment of the download shares it.
+func withDownloadLimiter(ctx context.Context, limiter *RateLimiter) context.Context {
+	return context.WithValue(ctx, downloadLimiterKey{}, limiter)
+}
+
+func downloadLimiter(ctx context.Context) *RateLimiter {
+	limiter, _ := ctx.Value(downloadLimiterKey{}).(*RateLimiter)
+	return limiter
+}
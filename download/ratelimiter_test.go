@@ -0,0 +1,75 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsBurst(t *testing.T) {
+	l := NewRateLimiter(100)
+	now := time.Now()
+
+	if delay, _, _ := l.reserve(100, now); delay != 0 {
+		t.Errorf("delay: expected %v, got %v", time.Duration(0), delay)
+	}
+
+	if delay, _, _ := l.reserve(50, now); delay != 500*time.Millisecond {
+		t.Errorf("delay: expected %v, got %v", 500*time.Millisecond, delay)
+	}
+
+	if delay, _, _ := l.reserve(50, now.Add(2*time.Second)); delay != 0 {
+		t.Errorf("delay: expected %v after refill, got %v", time.Duration(0), delay)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	l := NewRateLimiter(0)
+
+	if delay, _, _ := l.reserve(1<<30, time.Now()); delay != 0 {
+		t.Errorf("delay: expected %v, got %v", time.Duration(0), delay)
+	}
+}
+
+func TestRateLimiterWaitFollowsRateChanges(t *testing.T) {
+	for _, rate := range []uint64{0, 1 << 30} {
+		l := NewRateLimiter(1000)
+		l.Wait(context.Background(), 1000)
+
+		done := make(chan error)
+		go func() {
+			// 32 seconds of reading at the original rate
+			done <- l.Wait(context.Background(), 32*1000)
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		l.SetRate(rate)
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("rate %d: expected no error, got %v", rate, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("rate %d: wait didn't follow the new rate", rate)
+		}
+	}
+}
+
+func TestThrottledReaderStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := &ThrottledReader{
+		Reader:   bytes.NewReader(make([]byte, 64)),
+		Context:  ctx,
+		Limiters: []*RateLimiter{NewRateLimiter(1), nil}}
+
+	_, err := io.Copy(ioutil.Discard, r)
+	if err != context.Canceled {
+		t.Errorf("error: expected %v, got %v", context.Canceled, err)
+	}
+}
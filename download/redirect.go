@@ -0,0 +1,96 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxRedirects matches the limit of http.DefaultClient.
+const DefaultMaxRedirects = 10
+
+// Redirect is one hop on the way to a download's data: the URL requested
+// and the redirect status it answered with.
+type Redirect struct {
+	URL        string
+	StatusCode int
+}
+
+// RedirectsFromResponse returns the redirects followed to get res, oldest
+// first.
+func RedirectsFromResponse(res *http.Response) []Redirect {
+	var redirects []Redirect
+	for req := res.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		redirects = append([]Redirect{{
+			URL:        req.Response.Request.URL.String(),
+			StatusCode: req.Response.StatusCode}}, redirects...)
+	}
+	return redirects
+}
+
+// RedirectError is returned when the redirect policy refuses to follow a
+// redirect.
+type RedirectError struct {
+	URL    string
+	Reason string
+}
+
+func (e RedirectError) Error() string {
+	return fmt.Sprintf("redirect to %s refused: %s", e.URL, e.Reason)
+}
+
+// RedirectPolicy decides which redirects are followed. AllowedHosts holds
+// host names or wildcards such as "*.example.com" that redirects may lead
+// to besides the original host; when empty any host is allowed.
+type RedirectPolicy struct {
+	MaxRedirects uint
+	SameHost     bool
+	AllowedHosts []string
+	// AllowDowngrade follows redirects from https to plain http.
+	AllowDowngrade bool
+}
+
+// DefaultRedirectPolicy ...
+func DefaultRedirectPolicy() *RedirectPolicy {
+	return &RedirectPolicy{MaxRedirects: DefaultMaxRedirects}
+}
+
+// CheckRedirect is for use as http.Client's CheckRedirect.
+func (p *RedirectPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if p == nil {
+		p = DefaultRedirectPolicy()
+	}
+
+	target := req.URL.String()
+	if uint(len(via)) > p.MaxRedirects {
+		return RedirectError{URL: target, Reason: fmt.Sprintf("more than %d redirects", p.MaxRedirects)}
+	}
+
+	// the original host is compared with its port, as a different port
+	// may well be a different server
+	sameHost := strings.EqualFold(req.URL.Host, via[0].URL.Host)
+	if p.SameHost && !sameHost {
+		return RedirectError{URL: target, Reason: "only redirects to " + via[0].URL.Host + " are followed"}
+	}
+
+	allowed := bestHostMatch(strings.ToLower(req.URL.Hostname()), len(p.AllowedHosts), func(i int) string {
+		return p.AllowedHosts[i]
+	})
+	if len(p.AllowedHosts) > 0 && !sameHost && allowed < 0 {
+		return RedirectError{URL: target, Reason: "host not allowed"}
+	}
+
+	previous := via[len(via)-1]
+	if !p.AllowDowngrade && previous.URL.Scheme == "https" && req.URL.Scheme == "http" {
+		return RedirectError{URL: target, Reason: "downgrade from https"}
+	}
+
+	// headers are copied to each hop, so credentials are redone for the
+	// new URL: only host credentials that match it follow a redirect to
+	// another host
+	if hops, ok := req.Context().Value(authKey{}).(*authHops); ok {
+		hops.redirect(req, sameHost)
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serveRedirects(target string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/start", http.RedirectHandler("/middle", http.StatusFound))
+	mux.Handle("/middle", http.RedirectHandler(target, http.StatusMovedPermanently))
+	mux.HandleFunc("/data", func(rw http.ResponseWriter, req *http.Request) {
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader(testContent))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestFetchRecordsRedirects(t *testing.T) {
+	server := serveRedirects("/data")
+	defer server.Close()
+
+	f := &HTTPFetcher{Client: NewHTTPClient(&Transport{}, DefaultRedirectPolicy())}
+	source, err := f.FetchURL(context.Background(), server.URL+"/start", nil, &Metadata{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Close()
+
+	if source.Metadata.FinalURL != server.URL+"/data" {
+		t.Errorf("final-url: expected %s, got %s", server.URL+"/data", source.Metadata.FinalURL)
+	}
+
+	expected := []Redirect{
+		{URL: server.URL + "/start", StatusCode: http.StatusFound},
+		{URL: server.URL + "/middle", StatusCode: http.StatusMovedPermanently}}
+	redirects := source.Metadata.Redirects
+	if len(redirects) != len(expected) {
+		t.Fatalf("redirects: expected %v, got %v", expected, redirects)
+	}
+	for i := range expected {
+		if redirects[i] != expected[i] {
+			t.Errorf("redirect %d: expected %v, got %v", i, expected[i], redirects[i])
+		}
+	}
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	other := serveRedirects("/data")
+	defer other.Close()
+	server := serveRedirects(other.URL + "/data")
+	defer server.Close()
+
+	tests := []struct {
+		policy *RedirectPolicy
+		ok     bool
+	}{
+		{&RedirectPolicy{MaxRedirects: 2}, true},
+		{&RedirectPolicy{MaxRedirects: 1}, false},
+		{&RedirectPolicy{MaxRedirects: 2, SameHost: true}, false},
+		{&RedirectPolicy{MaxRedirects: 2, AllowedHosts: []string{"*.example.com"}}, false},
+		{&RedirectPolicy{MaxRedirects: 2, AllowedHosts: []string{"127.0.0.1"}}, true},
+	}
+	for _, test := range tests {
+		client := NewHTTPClient(&Transport{}, test.policy)
+		res, err := client.Get(server.URL + "/start")
+		if err == nil {
+			res.Body.Close()
+		}
+
+		if test.ok && err != nil {
+			t.Errorf("policy %+v: expected redirects to be followed, got %v", test.policy, err)
+		}
+		if !test.ok && ErrorKind(err) != ErrorKindRedirect {
+			t.Errorf("policy %+v: expected redirect error, got %v", test.policy, err)
+		}
+	}
+}
+
+func TestRedirectPolicyRefusesDowngrade(t *testing.T) {
+	plain := serveRedirects("/data")
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.RedirectHandler(plain.URL+"/data", http.StatusFound))
+	defer secure.Close()
+
+	tlsConfig := &TLSConfig{RootCAs: serverPool(secure)}
+
+	client := NewHTTPClient(&Transport{TLS: tlsConfig}, DefaultRedirectPolicy())
+	_, err := client.Get(secure.URL)
+	if ErrorKind(err) != ErrorKindRedirect {
+		t.Errorf("downgrade: expected redirect error, got %v", err)
+	}
+
+	client = NewHTTPClient(&Transport{TLS: tlsConfig}, &RedirectPolicy{MaxRedirects: 1, AllowDowngrade: true})
+	res, err := client.Get(secure.URL)
+	if err != nil {
+		t.Fatalf("downgrade: expected redirect to be followed, got %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestRedirectStripsAuthFromOtherHosts(t *testing.T) {
+	var received http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req.Header
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader(testContent))
+	}))
+	defer other.Close()
+	server := serveRedirects(other.URL + "/data")
+	defer server.Close()
+
+	auth := &Auth{Headers: map[string]string{"X-Api-Key": "some-key"}, BearerToken: "some-token"}
+
+	f := &HTTPFetcher{Client: NewHTTPClient(&Transport{}, DefaultRedirectPolicy())}
+	source, err := f.FetchURL(context.Background(), server.URL+"/start", auth, &Metadata{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Close()
+
+	for _, name := range []string{"X-Api-Key", "Authorization"} {
+		if received.Get(name) != "" {
+			t.Errorf("%s: expected none sent to %s, got %s", name, other.URL, received.Get(name))
+		}
+	}
+}
+
+func TestRedirectLooksUpHostCredentialsForEachHop(t *testing.T) {
+	var received http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req.Header
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader(testContent))
+	}))
+	defer other.Close()
+	server := serveRedirects(other.URL + "/data")
+	defer server.Close()
+
+	c := NewCredentials()
+	c.Hosts = &HostCredentials{entries: []HostCredential{
+		{Host: strings.TrimPrefix(server.URL, "http://"), Auth: Auth{Headers: map[string]string{"X-Api-Key": "server-key"}}},
+		{Host: strings.TrimPrefix(other.URL, "http://"), Auth: Auth{Headers: map[string]string{"X-Other-Key": "other-key"}}},
+	}}
+	c.Set("some-id", &Auth{BearerToken: "request-token"})
+
+	auth := c.For(&Download{ID: "some-id", URL: server.URL + "/start"})
+
+	f := &HTTPFetcher{Client: NewHTTPClient(&Transport{}, DefaultRedirectPolicy())}
+	source, err := f.FetchURL(context.Background(), server.URL+"/start", auth, &Metadata{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Close()
+
+	if received.Get("X-Api-Key") != "" || received.Get("Authorization") != "" {
+		t.Errorf("headers: expected %s's credentials left behind, got %v", server.URL, received)
+	}
+	if received.Get("X-Other-Key") != "other-key" {
+		t.Errorf("header: expected %s, got %s", "other-key", received.Get("X-Other-Key"))
+	}
+}
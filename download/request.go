@@ -1,14 +1,34 @@
 package download
 
+import "time"
+
 // Request ...
 type Request struct {
-	ID            string
-	URL           string
-	Checksum      string
-	ChecksumType  string
-	Callback      string
-	ETag          string
-	ContentLength uint64
+	ID                string
+	URL               string
+	Checksum          string
+	ChecksumType      string
+	Callback          string
+	ETag              string
+	ContentLength     uint64
+	Segments          uint
+	Priority          int
+	MaxBytesPerSecond uint64
+	// MaxSize refuses content larger than this many bytes. Zero means
+	// only the server's limit applies.
+	MaxSize uint64
+	// MaxAge is how old an existing download can be before the origin is
+	// asked whether it changed. Refresh asks regardless of age.
+	MaxAge  time.Duration
+	Refresh bool
+
+	Auth        *Auth
+	AuthProfile string
+}
+
+// Authenticated ...
+func (r *Request) Authenticated() bool {
+	return !r.Auth.IsEmpty() || r.AuthProfile != ""
 }
 
 // ResourceKey ...
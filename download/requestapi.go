@@ -1,19 +1,60 @@
 package download
 
 import (
+	"net/url"
+	"time"
+
 	"github.com/patdowney/downloaderd-worker/api"
 )
 
 // FromAPIIncomingDownload ...
 func FromAPIIncomingDownload(air *api.IncomingDownload) *Request {
+	sourceURL, auth := fromAPIAuth(air)
+
 	downloadReq := &Request{
-		ID:           air.RequestID,
-		URL:          air.URL,
-		Checksum:     air.Checksum,
-		ChecksumType: air.ChecksumType,
-		Callback:     air.Callback,
-		ETag:         air.ETag,
+		ID:                air.RequestID,
+		URL:               sourceURL,
+		Checksum:          air.Checksum,
+		ChecksumType:      air.ChecksumType,
+		Callback:          air.Callback,
+		ETag:              air.ETag,
+		Segments:          air.Segments,
+		Priority:          air.Priority,
+		MaxBytesPerSecond: air.MaxBytesPerSecond,
+		MaxSize:           air.MaxSize,
+		MaxAge:            time.Duration(air.MaxAge) * time.Second,
+		Refresh:           air.Refresh,
+		Auth:              auth,
+		AuthProfile:       air.AuthProfile,
 	}
 
 	return downloadReq
 }
+
+// fromAPIAuth gathers the credentials sent with a request. Any given in
+// the URL itself are moved out of it, so the URL can be shown safely.
+func fromAPIAuth(air *api.IncomingDownload) (string, *Auth) {
+	auth := &Auth{Headers: air.Headers}
+	sourceURL := air.URL
+
+	u, err := url.Parse(air.URL)
+	if err == nil && u.User != nil {
+		auth.Username = u.User.Username()
+		auth.Password, _ = u.User.Password()
+		u.User = nil
+		sourceURL = u.String()
+	}
+
+	if air.Auth != nil {
+		if air.Auth.Username != "" || air.Auth.Password != "" {
+			auth.Username = air.Auth.Username
+			auth.Password = air.Auth.Password
+		}
+		auth.BearerToken = air.Auth.BearerToken
+	}
+
+	if auth.IsEmpty() {
+		return sourceURL, nil
+	}
+	return sourceURL, auth
+}
@@ -0,0 +1,140 @@
+package download
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy ...
+type RetryPolicy struct {
+	MaxAttempts    uint
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter is the fraction of each backoff that is randomised, so
+	// workers retrying the same origin don't all return at once.
+	Jitter float64
+}
+
+// DefaultRetryPolicy ...
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+		Multiplier:     2,
+		Jitter:         0.2}
+}
+
+// ShouldRetry ...
+func (p *RetryPolicy) ShouldRetry(attempt uint, err error) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	return IsRetryable(err)
+}
+
+// Backoff returns how long to wait after the given attempt failed. A
+// Retry-After sent by the origin takes precedence over the policy, but is
+// still capped at MaxBackoff so an origin can't hold a worker for ever.
+func (p *RetryPolicy) Backoff(attempt uint, err error) time.Duration {
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > 0 {
+		if p.MaxBackoff > 0 && httpErr.RetryAfter > p.MaxBackoff {
+			return p.MaxBackoff
+		}
+		return httpErr.RetryAfter
+	}
+
+	backoff := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	backoff -= backoff * p.Jitter * rand.Float64()
+
+	return time.Duration(backoff)
+}
+
+// IsRetryable reports whether err looks transient enough that fetching
+// again might succeed.
+func IsRetryable(err error) bool {
+	// a certificate won't become trusted by asking again
+	if IsTLSError(err) {
+		return false
+	}
+	var blockedErr BlockedAddressError
+	if errors.As(err, &blockedErr) {
+		return false
+	}
+	if IsTimeout(err) {
+		return true
+	}
+
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// FTP reserves 4xx replies for failures worth trying again
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// ParseRetryAfter accepts either form of the Retry-After header, delay
+// seconds or an HTTP date, and returns the time left to wait.
+func ParseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	seconds, err := strconv.ParseUint(header, 10, 32)
+	if err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	retryTime, err := http.ParseTime(header)
+	if err == nil && retryTime.After(now) {
+		return retryTime.Sub(now)
+	}
+
+	return 0
+}
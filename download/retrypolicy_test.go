@@ -0,0 +1,112 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowsToMax(t *testing.T) {
+	p := &RetryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		actual := p.Backoff(uint(i+1), errors.New("some-error"))
+		if actual != e {
+			t.Errorf("backoff(%d): expected %v, got %v", i+1, e, actual)
+		}
+	}
+}
+
+func TestBackoffHonoursRetryAfter(t *testing.T) {
+	p := DefaultRetryPolicy()
+	err := HTTPError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 42 * time.Second}
+
+	actual := p.Backoff(1, err)
+	if actual != 42*time.Second {
+		t.Errorf("backoff: expected %v, got %v", 42*time.Second, actual)
+	}
+}
+
+func TestBackoffCapsRetryAfter(t *testing.T) {
+	p := DefaultRetryPolicy()
+	err := HTTPError{StatusCode: http.StatusTooManyRequests, RetryAfter: 99999999 * time.Second}
+
+	actual := p.Backoff(1, err)
+	if actual != p.MaxBackoff {
+		t.Errorf("backoff: expected %v, got %v", p.MaxBackoff, actual)
+	}
+}
+
+func TestParseRetryAfterDate(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2014-03-16T15:04:05Z")
+	header := now.Add(90 * time.Second).Format(http.TimeFormat)
+
+	actual := ParseRetryAfter(header, now)
+	if actual != 90*time.Second {
+		t.Errorf("retry-after: expected %v, got %v", 90*time.Second, actual)
+	}
+}
+
+func TestIsRetryableStatusCodes(t *testing.T) {
+	codes := map[int]bool{
+		http.StatusNotFound:            false,
+		http.StatusForbidden:           false,
+		http.StatusTooManyRequests:     true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusInternalServerError: true}
+
+	for code, expected := range codes {
+		actual := IsRetryable(HTTPError{StatusCode: code})
+		if actual != expected {
+			t.Errorf("retryable(%d): expected %v, got %v", code, expected, actual)
+		}
+	}
+}
+
+func TestSaveRetriesTransientFailures(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Write([]byte(testContent))
+	}))
+	defer server.Close()
+
+	fileStore := &MemoryFileStore{}
+	w := createTestWorker(fileStore, &RecordingStatusSender{})
+	w.RetryPolicy = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 1}
+
+	err := w.SaveWithStatus(context.Background(), &Download{
+		ID:           "some-dummy-downloadid",
+		URL:          server.URL,
+		ChecksumType: "sha256",
+		Metadata:     &Metadata{},
+		Status:       &Status{}})
+	if err != nil {
+		t.Errorf("save: unexpected error %v", err)
+	}
+
+	if string(fileStore.Data) != testContent {
+		t.Errorf("data: expected %s, got %s", testContent, fileStore.Data)
+	}
+
+	close(w.ErrorChannel)
+	var attempts []uint
+	for e := range w.ErrorChannel {
+		attempts = append(attempts, e.Attempt)
+	}
+	if len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Errorf("attempt-errors: expected [1 2], got %v", attempts)
+	}
+}
@@ -0,0 +1,265 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultScanTimeout ...
+const DefaultScanTimeout = 10 * time.Minute
+
+// clamdChunkSize is how much data is sent to clamd in each INSTREAM chunk.
+const clamdChunkSize = 64 * 1024
+
+// ScanVerdict ...
+type ScanVerdict string
+
+const (
+	// ScanClean ...
+	ScanClean ScanVerdict = "clean"
+	// ScanInfected ...
+	ScanInfected ScanVerdict = "infected"
+)
+
+// ScanResult is what a malware scanner made of a download. Signature
+// names what was found in infected data.
+type ScanResult struct {
+	Scanner   string
+	Verdict   ScanVerdict
+	Signature string
+}
+
+// InfectedError is returned by a ScanStage that finds malware, stopping
+// the pipeline before anything else handles the data.
+type InfectedError struct {
+	Signature string
+}
+
+func (e InfectedError) Error() string {
+	return fmt.Sprintf("infected: %s", e.Signature)
+}
+
+// Scanner checks a local file for malware.
+type Scanner interface {
+	Name() string
+	Scan(ctx context.Context, fileName string) (*ScanResult, error)
+}
+
+// ClamdScanner streams files to a clamd daemon with the INSTREAM command.
+// Network is "unix" for a socket path or "tcp" for a host and port.
+type ClamdScanner struct {
+	Network string
+	Address string
+}
+
+// Name ...
+func (s *ClamdScanner) Name() string {
+	return "clamd"
+}
+
+// Scan ...
+func (s *ClamdScanner) Scan(ctx context.Context, fileName string) (*ScanResult, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// unblock reads and writes when ctx is done
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	err = s.stream(conn, f)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+func (s *ClamdScanner) stream(conn net.Conn, data io.Reader) error {
+	_, err := conn.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, readErr := data.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			_, err = conn.Write(append(size, chunk[:n]...))
+			if err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	// a zero length chunk ends the stream
+	binary.BigEndian.PutUint32(size, 0)
+	_, err = conn.Write(size)
+	return err
+}
+
+// parseClamdReply reads replies such as "stream: OK" and
+// "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (*ScanResult, error) {
+	result := strings.TrimSpace(reply)
+	if i := strings.Index(result, ": "); i >= 0 {
+		result = result[i+2:]
+	}
+
+	switch {
+	case result == "OK":
+		return &ScanResult{Scanner: "clamd", Verdict: ScanClean}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		signature := strings.TrimSuffix(result, " FOUND")
+		return &ScanResult{Scanner: "clamd", Verdict: ScanInfected, Signature: signature}, nil
+	}
+	return nil, fmt.Errorf("clamd: %s", reply)
+}
+
+// CommandScanner runs an external scanner with the file name as its last
+// argument. Following clamscan, exit status 0 means clean and 1 means
+// infected, with the signature taken from a "name: signature FOUND" line
+// of the output if there is one. Any other status is a failed scan.
+type CommandScanner struct {
+	Path string
+	Args []string
+}
+
+// Name ...
+func (s *CommandScanner) Name() string {
+	return "command"
+}
+
+// Scan ...
+func (s *CommandScanner) Scan(ctx context.Context, fileName string) (*ScanResult, error) {
+	args := append(append([]string{}, s.Args...), fileName)
+	output, err := exec.CommandContext(ctx, s.Path, args...).CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return &ScanResult{Scanner: s.Path, Verdict: ScanClean}, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return &ScanResult{Scanner: s.Path, Verdict: ScanInfected, Signature: scannerSignature(output)}, nil
+	}
+
+	output = bytes.TrimSpace(output)
+	if len(output) > maxCommandOutput {
+		output = output[len(output)-maxCommandOutput:]
+	}
+	return nil, fmt.Errorf("%s: %v: %s", s.Path, err, output)
+}
+
+func scannerSignature(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if !strings.HasSuffix(line, " FOUND") {
+			continue
+		}
+		if i := strings.LastIndex(line, ": "); i >= 0 {
+			line = line[i+2:]
+		}
+		return strings.TrimSuffix(line, " FOUND")
+	}
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// ParseScanner reads a scanner written as clamd:socket-path,
+// clamd:host:port or command:path [args].
+func ParseScanner(value string) (Scanner, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return nil, fmt.Errorf("scanner %q: expected clamd:address or command:path [args]", value)
+	}
+	address := strings.TrimSpace(parts[1])
+
+	switch parts[0] {
+	case "clamd":
+		if strings.HasPrefix(address, "/") {
+			return &ClamdScanner{Network: "unix", Address: address}, nil
+		}
+		return &ClamdScanner{Network: "tcp", Address: address}, nil
+	case "command":
+		fields := strings.Fields(address)
+		return &CommandScanner{Path: fields[0], Args: fields[1:]}, nil
+	}
+
+	return nil, fmt.Errorf("unknown scanner: '%s'", parts[0])
+}
+
+// ScanStage checks the data with Scanner, failing the download if it is
+// infected. It should come first, before other stages open the data.
+type ScanStage struct {
+	Scanner Scanner
+	Timeout time.Duration
+}
+
+// Name ...
+func (s *ScanStage) Name() string {
+	return "scan"
+}
+
+// Run ...
+func (s *ScanStage) Run(ctx context.Context, run *StageRun) error {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	result, err := s.Scanner.Scan(ctx, run.Input)
+	if err != nil {
+		return err
+	}
+
+	run.Scan = result
+	if result.Verdict == ScanInfected {
+		return InfectedError{Signature: result.Signature}
+	}
+	return nil
+}
+
+// QuarantineStore is implemented by file stores that can move infected
+// data out of the way. Once a download is Quarantined, the store's
+// readers and Delete work on the quarantined copy.
+type QuarantineStore interface {
+	Quarantine(*Download) error
+}
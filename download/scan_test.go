@@ -0,0 +1,157 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// serveClamd answers INSTREAM requests like clamd, finding the EICAR test
+// string.
+func serveClamd(t *testing.T) string {
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				command := make([]byte, len("zINSTREAM\x00"))
+				io.ReadFull(conn, command)
+
+				var data bytes.Buffer
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(conn, size); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size)
+					if n == 0 {
+						break
+					}
+					io.CopyN(&data, conn, int64(n))
+				}
+
+				if strings.Contains(data.String(), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE") {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+
+	return socket
+}
+
+type quarantiningStore struct {
+	memoryArtifactStore
+	quarantined bool
+}
+
+func (s *quarantiningStore) Quarantine(d *Download) error {
+	s.quarantined = true
+	return nil
+}
+
+func TestSaveQuarantinesInfectedData(t *testing.T) {
+	scanner := &ClamdScanner{Network: "unix", Address: serveClamd(t)}
+
+	tests := []struct {
+		content string
+		verdict ScanVerdict
+		state   State
+	}{
+		{testContent, ScanClean, StateSucceeded},
+		{eicar, ScanInfected, StateFailed},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			http.ServeContent(rw, req, "", time.Time{}, strings.NewReader(test.content))
+		}))
+
+		store := &quarantiningStore{}
+		sender := &RecordingStatusSender{}
+		w := createTestWorker(store, sender)
+		w.Pipeline = &Pipeline{Stages: []Stage{&ScanStage{Scanner: scanner}, &ChecksumStage{}}}
+
+		d := &Download{
+			ID:           "some-dummy-downloadid",
+			URL:          server.URL + "/file",
+			ChecksumType: "sha256",
+			Status:       &Status{}}
+		w.SaveWithStatus(context.Background(), d)
+		server.Close()
+
+		last := sender.Last()
+		d.AddStatusUpdate(&last)
+		if last.State != test.state {
+			t.Errorf("%s: expected %s, got %s", test.verdict, test.state, last.State)
+		}
+		if d.Scan == nil || d.Scan.Verdict != test.verdict {
+			t.Fatalf("%s: unexpected scan %v", test.verdict, d.Scan)
+		}
+		if d.Infected() != store.quarantined || d.Quarantined != store.quarantined {
+			t.Errorf("%s: expected quarantined to be %v", test.verdict, d.Infected())
+		}
+
+		if test.verdict == ScanInfected {
+			if d.Scan.Signature != "Eicar-Signature" {
+				t.Errorf("signature: expected %s, got %s", "Eicar-Signature", d.Scan.Signature)
+			}
+			if len(last.Stages) != 1 {
+				t.Errorf("stages: expected the pipeline to stop at the scan, got %v", last.Stages)
+			}
+			e := <-w.ErrorChannel
+			if e.Kind != ErrorKindInfected {
+				t.Errorf("error: expected kind %s, got %v", ErrorKindInfected, e)
+			}
+		}
+	}
+}
+
+func TestCommandScanner(t *testing.T) {
+	tests := []struct {
+		script    string
+		verdict   ScanVerdict
+		signature string
+	}{
+		{`exit 0`, ScanClean, ""},
+		{`echo "$0: Win.Test.EICAR_HDB-1 FOUND"; exit 1`, ScanInfected, "Win.Test.EICAR_HDB-1"},
+	}
+	for _, test := range tests {
+		scanner := &CommandScanner{Path: "sh", Args: []string{"-c", test.script}}
+		result, err := scanner.Scan(context.Background(), "/tmp/file")
+		if err != nil {
+			t.Fatalf("%s: %v", test.script, err)
+		}
+		if result.Verdict != test.verdict || result.Signature != test.signature {
+			t.Errorf("%s: expected %s %s, got %v", test.script, test.verdict, test.signature, result)
+		}
+	}
+
+	scanner := &CommandScanner{Path: "sh", Args: []string{"-c", "echo cannot read; exit 2"}}
+	_, err := scanner.Scan(context.Background(), "/tmp/file")
+	if err == nil || !strings.Contains(err.Error(), "cannot read") {
+		t.Errorf("failure: expected the scanner's output, got %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package download
+
+import (
+	"io"
+)
+
+// SegmentWriter writes one range of a segmented download in place and
+// counts the bytes against the download's shared StatusWriter.
+type SegmentWriter struct {
+	Output       io.WriterAt
+	Offset       int64
+	StatusWriter *StatusWriter
+}
+
+func (w *SegmentWriter) Write(bytes []byte) (int, error) {
+	byteCount, err := w.Output.WriteAt(bytes, w.Offset)
+	w.Offset += int64(byteCount)
+	limitErr := w.StatusWriter.AddBytesRead(byteCount)
+	if err == nil {
+		err = limitErr
+	}
+
+	return byteCount, err
+}
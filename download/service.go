@@ -1,12 +1,22 @@
 package download
 
 import (
+	"context"
+	"errors"
 	"io"
-	//	"log"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/patdowney/downloaderd-common/common"
 )
 
+// resumeBatchSize is how many unfinished downloads are read from the
+// store at a time when re-queueing them at startup.
+const resumeBatchSize = 25
+
 // Service ...
 type Service struct {
 	Clock       common.Clock
@@ -14,37 +24,110 @@ type Service struct {
 
 	updateChannel chan StatusUpdate
 	errorChannel  chan Error
-	downloadQueue chan Download
+	queue         Queue
 
 	WorkerCount uint
-	QueueLength uint
+	// QueueLength is how many downloads can wait for a worker before new
+	// requests are turned away. Zero means no limit.
+	QueueLength  uint
+	SegmentCount uint
+	RetryPolicy  *RetryPolicy
+	HostLimiter  *HostLimiter
+	// RateLimiter caps the bandwidth used by all workers together.
+	RateLimiter *RateLimiter
+	Preflight   bool
+	// Fetchers are keyed by the URL scheme they handle.
+	Fetchers    map[string]Fetcher
+	Credentials *Credentials
+	// Proxies, TLS, Timeouts, Redirects and Addresses configure the
+	// requests HTTPClient sends.
+	Proxies     *ProxyConfig
+	TLS         *TLSConfig
+	Timeouts    *Timeouts
+	Redirects   *RedirectPolicy
+	Addresses   *AddressPolicy
+	HTTPClient  *http.Client
+	StallPolicy *StallPolicy
+	Limits      *Limits
+	Pipeline    *Pipeline
+
+	// DeleteOnChecksumMismatch removes data that doesn't match the
+	// checksum given in the request.
+	DeleteOnChecksumMismatch bool
 
 	HookService *HookService
 
 	fileStore     FileStore
 	downloadStore Store
+	cancellations *Cancellations
+	versionLock   sync.Mutex
+
+	// deletions are running downloads deleted while their worker stops,
+	// removed once it reports they finished.
+	deletions    map[string]bool
+	deletionLock sync.Mutex
 }
 
 // NewDownloadService ...
-func NewDownloadService(downloadStore Store, fileStore FileStore, workerCount uint, queueLength uint) *Service {
+func NewDownloadService(downloadStore Store, fileStore FileStore, queue Queue, workerCount uint, queueLength uint) *Service {
+	transport := &Transport{
+		Proxies:   &ProxyConfig{},
+		TLS:       &TLSConfig{},
+		Timeouts:  &Timeouts{},
+		Addresses: &AddressPolicy{}}
+	redirects := DefaultRedirectPolicy()
+	httpClient := NewHTTPClient(transport, redirects)
+	clock := &common.RealClock{}
+
 	s := Service{
 		IDGenerator:   &UUIDGenerator{},
-		Clock:         &common.RealClock{},
+		Clock:         clock,
 		WorkerCount:   workerCount,
 		QueueLength:   queueLength,
+		RetryPolicy:   DefaultRetryPolicy(),
+		HostLimiter:   NewHostLimiter(nil),
+		RateLimiter:   NewRateLimiter(0),
+		Fetchers:      DefaultFetchers(httpClient, clock),
+		Proxies:       transport.Proxies,
+		TLS:           transport.TLS,
+		Timeouts:      transport.Timeouts,
+		Redirects:     redirects,
+		Addresses:     transport.Addresses,
+		StallPolicy:   &StallPolicy{},
+		Limits:        &Limits{},
+		Pipeline:      &Pipeline{},
+		HTTPClient:    httpClient,
+		Credentials:   NewCredentials(),
 		updateChannel: make(chan StatusUpdate), //, queueLength),
 		errorChannel:  make(chan Error, workerCount),
-		downloadQueue: make(chan Download, queueLength),
+		queue:         queue,
 		fileStore:     fileStore,
-		downloadStore: downloadStore}
+		downloadStore: downloadStore,
+		cancellations: NewCancellations(),
+		deletions:     make(map[string]bool)}
 
 	return &s
 }
 
 // StartWorkers ...
 func (s *Service) StartWorkers() {
+	s.HostLimiter.OnChange = s.queue.Wake
+
 	for workerID := uint(0); workerID < s.WorkerCount; workerID++ {
-		w := NewWorker(workerID, s.downloadQueue, s.updateChannel, s.errorChannel, s.fileStore)
+		w := NewWorker(workerID, s.queue, s.downloadStore, s.updateChannel, s.errorChannel, s.fileStore)
+		w.SegmentCount = s.SegmentCount
+		w.RetryPolicy = s.RetryPolicy
+		w.Cancellations = s.cancellations
+		w.HostLimiter = s.HostLimiter
+		w.RateLimiter = s.RateLimiter
+		w.Preflight = s.Preflight
+		w.Fetchers = s.Fetchers
+		w.Credentials = s.Credentials
+		w.HTTPClient = s.HTTPClient
+		w.Proxies = s.Proxies
+		w.StallPolicy = s.StallPolicy
+		w.Limits = s.Limits
+		w.Pipeline = s.Pipeline
 		w.start()
 	}
 }
@@ -55,11 +138,10 @@ func (s *Service) ProcessError(downloadError *Error) {
 
 	if download != nil {
 		download.Errors = append(download.Errors, *downloadError)
+		s.downloadStore.Update(download)
 	} else {
-		e := Error{DownloadID: downloadError.DownloadID}
-		e.Time = s.Clock.Now()
-		e.OriginalError = "status received before metadata"
-		s.errorChannel <- e
+		// deleted since, so there is nothing to record it on
+		log.Printf("error-for-unknown-download(%s): %s", downloadError.DownloadID, downloadError.OriginalError)
 	}
 }
 
@@ -69,16 +151,34 @@ func (s *Service) ProcessStatusUpdate(statusUpdate *StatusUpdate) {
 
 	if download != nil {
 		download.AddStatusUpdate(statusUpdate)
+		finished := statusUpdate.State != "" && download.IsFinished()
+
+		if finished && download.ChecksumFailed() && s.DeleteOnChecksumMismatch {
+			_, err := s.fileStore.Delete(download)
+			if err != nil {
+				log.Printf("checksum-mismatch-delete-error(%s): %v", download.ID, err)
+			}
+		}
+		if finished && download.State == StateCancelled {
+			s.deletePartialData(download)
+		}
+		if finished {
+			s.Credentials.Forget(download.ID)
+		}
+		if finished && s.claimDeletion(download.ID) {
+			err := s.remove(download)
+			if err != nil {
+				log.Printf("delete-error(%s): %v", download.ID, err)
+			}
+			return
+		}
 		s.downloadStore.Update(download)
 
-		if download.Finished && s.HookService != nil {
+		if finished && s.HookService != nil {
 			s.HookService.Notify(download)
 		}
 	} else {
-		e := Error{DownloadID: statusUpdate.DownloadID}
-		e.Time = s.Clock.Now()
-		e.OriginalError = "status received before metadata"
-		s.errorChannel <- e
+		log.Printf("status-for-unknown-download(%s): %s", statusUpdate.DownloadID, statusUpdate.State)
 	}
 }
 
@@ -96,13 +196,63 @@ func (s *Service) StartEventHandlers() {
 	}()
 }
 
+// ResumeUnfinished re-queues downloads that were in progress when the
+// service last stopped, along with any waiting download missing from the
+// queue. Workers pick up from the data already stored where the origin
+// allows it.
+func (s *Service) ResumeUnfinished() error {
+	var offset uint
+	for {
+		unfinished, err := s.downloadStore.FindNotFinished(offset, resumeBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, download := range unfinished {
+			if download.State == StateRunning {
+				download.Transition(StateQueued, s.Clock.Now())
+				s.downloadStore.Update(download)
+			}
+
+			err = s.enqueue(download, download.TimeRequested)
+			if err != nil {
+				return err
+			}
+		}
+
+		if uint(len(unfinished)) < resumeBatchSize {
+			return nil
+		}
+		offset += resumeBatchSize
+	}
+}
+
 // Start ...
 func (s *Service) Start() {
 	s.StartWorkers()
 	s.StartEventHandlers()
+
+	go func() {
+		err := s.ResumeUnfinished()
+		if err != nil {
+			log.Printf("resume-unfinished-error: %v", err)
+		}
+	}()
+}
+
+func (s *Service) enqueue(download *Download, timeQueued time.Time) error {
+	return s.queue.Push(QueueItem{
+		DownloadID: download.ID,
+		Host:       HostOf(download.URL),
+		Priority:   download.Priority,
+		TimeQueued: timeQueued})
 }
 
 func (s *Service) createDownload(downloadRequest *Request) (*Download, error) {
+	if s.QueueLength > 0 && uint(s.queue.Len()) >= s.QueueLength {
+		return nil, ErrQueueFull
+	}
+
 	id, err := s.IDGenerator.GenerateID()
 	if err != nil {
 		return nil, err
@@ -112,19 +262,66 @@ func (s *Service) createDownload(downloadRequest *Request) (*Download, error) {
 	if downloadRequest.Callback != "" && s.HookService != nil {
 		s.HookService.Register(download.ID, downloadRequest.ID, downloadRequest.Callback)
 	}
-	err = s.downloadStore.Add(download)
+	s.Credentials.Set(download.ID, downloadRequest.Auth)
 
-	s.downloadQueue <- *download
+	err = s.addVersion(download)
+	if err != nil {
+		return download, err
+	}
+
+	err = s.enqueue(download, download.TimeRequested)
 
 	return download, err
 }
 
-// ProcessRequest ...
-func (s *Service) ProcessRequest(downloadRequest *Request) (*Download, error) {
+// addVersion stores download as the newest version of its URL.
+func (s *Service) addVersion(download *Download) error {
+	s.versionLock.Lock()
+	defer s.versionLock.Unlock()
+
+	latest, err := s.downloadStore.FindVersions(download.URL, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	download.Version = 1
+	if len(latest) > 0 {
+		download.Version = latest[0].VersionNumber() + 1
+	}
+
+	return s.downloadStore.Add(download)
+}
+
+// ProcessRequest finds or creates the download for downloadRequest. ctx
+// bounds any request to the origin made on the way, such as asking
+// whether an existing download is still current.
+func (s *Service) ProcessRequest(ctx context.Context, downloadRequest *Request) (*Download, error) {
+	// what one set of credentials can see isn't shared with another
+	if downloadRequest.Authenticated() {
+		return s.createDownload(downloadRequest)
+	}
+
 	download, err := s.downloadStore.FindByResourceKey(downloadRequest.ResourceKey())
 	if err != nil {
 		return nil, err
 	}
+	if download != nil && download.Authenticated {
+		download = nil
+	}
+
+	if download != nil && download.Stale(downloadRequest, s.Clock.Now()) {
+		download, err = s.revalidate(ctx, download)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if download == nil && downloadRequest.Checksum != "" {
+		download, err = s.aliasByChecksum(downloadRequest)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	if download != nil {
 		// notify request callback
@@ -140,9 +337,103 @@ func (s *Service) ProcessRequest(downloadRequest *Request) (*Download, error) {
 	return download, err
 }
 
-// ListFinished ...
-func (s *Service) ListFinished() ([]*Download, error) {
-	return s.downloadStore.FindFinished(0, 25)
+// aliasByChecksum finds an existing download of the data the request
+// gives the checksum of, recording the request's URL as another source of
+// it. Returns nil if there isn't one to share.
+func (s *Service) aliasByChecksum(downloadRequest *Request) (*Download, error) {
+	existing, err := s.ListByChecksum(downloadRequest.ChecksumType, strings.TrimSpace(downloadRequest.Checksum))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, download := range existing {
+		// data that may have been deleted or set aside can't be shared
+		if download.Authenticated || download.Quarantined || download.ChecksumFailed() {
+			continue
+		}
+
+		if download.URL == downloadRequest.URL {
+			return download, nil
+		}
+		return s.downloadStore.AddSource(download.ID, downloadRequest.URL)
+	}
+
+	return nil, nil
+}
+
+// revalidate returns the existing download if the origin says it is
+// still current, or nil if a new version should be fetched. Origins that
+// can't be reached leave the existing download in place.
+func (s *Service) revalidate(ctx context.Context, download *Download) (*Download, error) {
+	// other sources can't be asked whether they changed, so they are
+	// fetched again
+	if !download.Succeeded() || !IsHTTP(download.URL) {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RevalidateTimeout)
+	defer cancel()
+
+	current, metadata, err := Revalidate(ctx, s.HTTPClient, download, s.Credentials.For(download))
+	if err != nil {
+		log.Printf("revalidate-error(%s): %v", download.ID, err)
+		return download, nil
+	}
+	if !current {
+		return nil, nil
+	}
+
+	download.Revalidated(metadata, s.Clock.Now())
+	err = s.downloadStore.Update(download)
+
+	return download, err
+}
+
+// HasAuthProfile reports whether an auth profile with the given name is
+// configured.
+func (s *Service) HasAuthProfile(name string) bool {
+	return s.Credentials.HasProfile(name)
+}
+
+// SupportsScheme reports whether downloads can be fetched from URLs with
+// the given scheme.
+func (s *Service) SupportsScheme(scheme string) bool {
+	_, ok := s.Fetchers[scheme]
+	return ok
+}
+
+// CheckSource turns away a source whose host resolves to an address the
+// Addresses policy blocks. Other lookup failures are left for the worker
+// to report, and every connection the worker makes is checked again.
+func (s *Service) CheckSource(sourceURL string) error {
+	err := s.Addresses.CheckURL(context.Background(), sourceURL)
+
+	var blockedErr BlockedAddressError
+	if errors.As(err, &blockedErr) {
+		return err
+	}
+	return nil
+}
+
+// ListByChecksum lists the succeeded downloads whose data has the given
+// checksum.
+func (s *Service) ListByChecksum(checksumType string, checksum string) ([]*Download, error) {
+	return s.downloadStore.FindByChecksum(strings.ToLower(checksumType), strings.ToLower(checksum), 0, 25)
+}
+
+// ListSucceeded ...
+func (s *Service) ListSucceeded() ([]*Download, error) {
+	return s.downloadStore.FindByState(StateSucceeded, 0, 25)
+}
+
+// ListFailed ...
+func (s *Service) ListFailed() ([]*Download, error) {
+	return s.downloadStore.FindByState(StateFailed, 0, 25)
+}
+
+// ListCancelled ...
+func (s *Service) ListCancelled() ([]*Download, error) {
+	return s.downloadStore.FindByState(StateCancelled, 0, 25)
 }
 
 // ListNotFinished ...
@@ -152,12 +443,44 @@ func (s *Service) ListNotFinished() ([]*Download, error) {
 
 // ListInProgress ...
 func (s *Service) ListInProgress() ([]*Download, error) {
-	return s.downloadStore.FindInProgress(0, 25)
+	return s.downloadStore.FindByState(StateRunning, 0, 25)
 }
 
-// ListWaiting ...
+// ListWaiting lists queued downloads in the order workers will take them,
+// along with why each one hasn't started yet.
 func (s *Service) ListWaiting() ([]*Download, error) {
-	return s.downloadStore.FindWaiting(0, 25)
+	items, err := s.queue.List()
+	if err != nil {
+		return nil, err
+	}
+
+	waiting := make([]*Download, 0, len(items))
+	for _, item := range items {
+		if len(waiting) == 25 {
+			break
+		}
+
+		download, err := s.FindByID(item.DownloadID)
+		if err != nil {
+			return nil, err
+		}
+		if download != nil {
+			held := *download
+			held.HoldReason = s.HostLimiter.HoldReason(item.Host)
+			if held.HoldReason == "" {
+				held.HoldReason = "waiting for a free worker"
+			}
+			waiting = append(waiting, &held)
+		}
+	}
+
+	return waiting, nil
+}
+
+// ListVersions lists the retained versions of the download of sourceURL,
+// newest first.
+func (s *Service) ListVersions(sourceURL string) ([]*Download, error) {
+	return s.downloadStore.FindVersions(sourceURL, 0, 25)
 }
 
 // ListAll ...
@@ -165,19 +488,111 @@ func (s *Service) ListAll() ([]*Download, error) {
 	return s.downloadStore.FindAll(0, 25)
 }
 
+// Cancel stops a queued or running download. Queued downloads are marked
+// cancelled straight away; running downloads are marked once their worker
+// has stopped. Returns nil if the download doesn't exist.
+func (s *Service) Cancel(id string) (*Download, error) {
+	download, err := s.FindByID(id)
+	if err != nil || download == nil {
+		return nil, err
+	}
+
+	if download.IsFinished() {
+		return nil, StateError{From: download.State, To: StateCancelled}
+	}
+
+	removed, err := s.queue.Remove(download.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !removed && s.cancellations.Cancel(download.ID) {
+		// the worker reports the cancelled state when it stops
+		return download, nil
+	}
+
+	err = download.Transition(StateCancelled, s.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.downloadStore.Update(download)
+	if err != nil {
+		return nil, err
+	}
+
+	s.deletePartialData(download)
+	s.Credentials.Forget(download.ID)
+
+	if s.HookService != nil {
+		s.HookService.Notify(download)
+	}
+
+	return download, nil
+}
+
+func (s *Service) deletePartialData(download *Download) {
+	_, err := s.fileStore.Delete(download)
+	if err != nil {
+		log.Printf("cancel-delete-error(%s): %v", download.ID, err)
+	}
+}
+
+// SetPriority moves a queued download ahead of or behind other waiting
+// downloads. Returns nil if the download doesn't exist.
+func (s *Service) SetPriority(id string, priority int) (*Download, error) {
+	download, err := s.FindByID(id)
+	if err != nil || download == nil {
+		return nil, err
+	}
+
+	queued, err := s.queue.SetPriority(download.ID, priority)
+	if err != nil {
+		return nil, err
+	}
+	if !queued {
+		return nil, ErrNotQueued
+	}
+
+	download.Priority = priority
+	err = s.downloadStore.Update(download)
+
+	return download, err
+}
+
 // FindByID ...
 func (s *Service) FindByID(id string) (*Download, error) {
 	return s.downloadStore.FindByID(id)
 }
 
-// Delete ...
+// Delete removes a download's data and record. A download a worker is
+// fetching is cancelled, and removed once the worker reports it stopped,
+// so its last updates still find it.
 func (s *Service) Delete(download *Download) (bool, error) {
-	_, err := s.fileStore.Delete(download)
-	if err != nil {
-		return false, err
+	if !download.IsFinished() {
+		removed, err := s.queue.Remove(download.ID)
+		if err != nil {
+			return false, err
+		}
+		s.Credentials.Forget(download.ID)
+
+		if !removed {
+			s.markDeletion(download.ID)
+			if s.cancellations.Cancel(download.ID) {
+				// the worker may have reported it finished before it was
+				// marked, in which case nothing else will remove it
+				current, err := s.FindByID(download.ID)
+				if err != nil || current == nil || !current.IsFinished() || !s.claimDeletion(download.ID) {
+					return true, err
+				}
+				download = current
+			} else {
+				s.claimDeletion(download.ID)
+			}
+		}
 	}
 
-	err = s.downloadStore.Delete(download)
+	err := s.remove(download)
 	if err != nil {
 		return false, err
 	}
@@ -185,6 +600,62 @@ func (s *Service) Delete(download *Download) (bool, error) {
 	return true, nil
 }
 
+// remove deletes a download's data, artifacts and record.
+func (s *Service) remove(download *Download) error {
+	if s.dataWritten(download) {
+		_, err := s.fileStore.Delete(download)
+		if err != nil {
+			return err
+		}
+	}
+
+	if artifactStore, ok := s.fileStore.(ArtifactStore); ok && len(download.Stages) > 0 {
+		err := artifactStore.DeleteArtifacts(download)
+		if err != nil {
+			log.Printf("delete-artifacts-error(%s): %v", download.ID, err)
+		}
+	}
+
+	return s.downloadStore.Delete(download)
+}
+
+// dataWritten reports whether download may have data in the file store.
+// Downloads that never started have none, and the data of cancelled
+// downloads and ones that failed their checksum may already be gone.
+func (s *Service) dataWritten(download *Download) bool {
+	if download.State == StateCancelled || (download.ChecksumFailed() && s.DeleteOnChecksumMismatch) {
+		return false
+	}
+	if download.Blob != "" || len(download.StateHistory) == 0 {
+		return true
+	}
+
+	for _, transition := range download.StateHistory {
+		if transition.State == StateRunning {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) markDeletion(id string) {
+	s.deletionLock.Lock()
+	defer s.deletionLock.Unlock()
+
+	s.deletions[id] = true
+}
+
+// claimDeletion reports whether id was marked for deletion, unmarking it
+// so only one caller removes the download.
+func (s *Service) claimDeletion(id string) bool {
+	s.deletionLock.Lock()
+	defer s.deletionLock.Unlock()
+
+	marked := s.deletions[id]
+	delete(s.deletions, id)
+	return marked
+}
+
 // DeleteByID ...
 func (s *Service) DeleteByID(id string) (bool, error) {
 	d, err := s.FindByID(id)
@@ -201,6 +672,15 @@ func (s *Service) DeleteByID(id string) (bool, error) {
 	return s.Delete(d)
 }
 
+// GetArtifactReader returns the named artifact of a processed download.
+func (s *Service) GetArtifactReader(download *Download, name string) (io.ReadCloser, error) {
+	artifactStore, ok := s.fileStore.(ArtifactStore)
+	if !ok {
+		return nil, ErrNoArtifacts
+	}
+	return artifactStore.GetArtifactReader(download, name)
+}
+
 // GetReader ...
 func (s *Service) GetReader(download *Download) (io.Reader, error) {
 	return s.fileStore.GetReader(download)
@@ -0,0 +1,269 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore holds just enough of a Store for requests to be matched
+// with existing downloads.
+type memoryStore struct {
+	Store
+	sync.Mutex
+	downloads []*Download
+}
+
+func (s *memoryStore) FindByResourceKey(resourceKey ResourceKey) (*Download, error) {
+	return nil, nil
+}
+
+func (s *memoryStore) FindByChecksum(checksumType string, checksum string, offset uint, count uint) ([]*Download, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var found []*Download
+	for _, d := range s.downloads {
+		if d.Succeeded() && d.HasChecksum(checksumType, checksum) {
+			found = append(found, d)
+		}
+	}
+	return found, nil
+}
+
+func (s *memoryStore) FindByID(downloadID string) (*Download, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, d := range s.downloads {
+		if d.ID == downloadID {
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) Update(d *Download) error {
+	return nil
+}
+
+func (s *memoryStore) Delete(d *Download) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var kept []*Download
+	for _, stored := range s.downloads {
+		if stored.ID != d.ID {
+			kept = append(kept, stored)
+		}
+	}
+	s.downloads = kept
+	return nil
+}
+
+func (s *memoryStore) AddSource(downloadID string, sourceURL string) (*Download, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, d := range s.downloads {
+		if d.ID == downloadID {
+			d.AddSource(sourceURL)
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) SetBlob(downloadID string, checksum string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, d := range s.downloads {
+		if d.ID == downloadID {
+			d.Blob = checksum
+		}
+	}
+	return nil
+}
+
+// recordingHookStore keeps registered hooks and which downloads were
+// notified, without sending anything.
+type recordingHookStore struct {
+	HookStore
+	hooks    []*Hook
+	notified []string
+}
+
+func (s *recordingHookStore) Add(h *Hook) error {
+	s.hooks = append(s.hooks, h)
+	return nil
+}
+
+func (s *recordingHookStore) FindByDownloadID(downloadID string) ([]*Hook, error) {
+	s.notified = append(s.notified, downloadID)
+	return nil, nil
+}
+
+const testSHA256 = "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e"
+
+func TestProcessRequestAliasesExistingChecksum(t *testing.T) {
+	existing := &Download{
+		ID:           "existing",
+		URL:          "http://one.example.com/data",
+		Checksum:     testSHA256,
+		ChecksumType: "sha256",
+		State:        StateSucceeded}
+	hooks := &recordingHookStore{}
+
+	s := NewDownloadService(&memoryStore{downloads: []*Download{existing}}, &MemoryFileStore{}, nil, 0, 0)
+	s.HookService = NewHookService(hooks, nil)
+
+	for i := 0; i < 2; i++ {
+		d, err := s.ProcessRequest(context.Background(), &Request{
+			ID:           "request",
+			URL:          "http://two.example.com/data",
+			Checksum:     strings.ToUpper(testSHA256),
+			ChecksumType: "SHA256",
+			Callback:     "http://hooks.example.com/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != existing {
+			t.Fatalf("download: expected %s, got %v", existing.ID, d)
+		}
+	}
+
+	if len(existing.Sources) != 1 || existing.Sources[0] != "http://two.example.com/data" {
+		t.Errorf("sources: expected %v, got %v", []string{"http://two.example.com/data"}, existing.Sources)
+	}
+	if len(hooks.hooks) != 2 || hooks.hooks[0].DownloadID != existing.ID {
+		t.Errorf("hooks: expected callbacks registered for %s, got %v", existing.ID, hooks.hooks)
+	}
+	if len(hooks.notified) != 2 || hooks.notified[0] != existing.ID {
+		t.Errorf("notified: expected %s notified, got %v", existing.ID, hooks.notified)
+	}
+}
+
+func TestAliasByChecksumSkipsUnsharedDownloads(t *testing.T) {
+	unshared := []*Download{
+		{ID: "authenticated", Authenticated: true},
+		{ID: "quarantined", Quarantined: true},
+		{ID: "mismatched", ChecksumVerdict: ChecksumMismatched},
+	}
+	for _, d := range unshared {
+		d.URL = "http://one.example.com/data"
+		d.Checksum = testSHA256
+		d.ChecksumType = "sha256"
+		d.State = StateSucceeded
+	}
+
+	s := NewDownloadService(&memoryStore{downloads: unshared}, &MemoryFileStore{}, nil, 0, 0)
+
+	d, err := s.aliasByChecksum(&Request{
+		URL:          "http://two.example.com/data",
+		Checksum:     testSHA256,
+		ChecksumType: "sha256"})
+	if err != nil || d != nil {
+		t.Errorf("alias: expected none, got %v, %v", d, err)
+	}
+	for _, d := range unshared {
+		if len(d.Sources) != 0 {
+			t.Errorf("sources(%s): expected none, got %v", d.ID, d.Sources)
+		}
+	}
+}
+
+// dequeuedQueue is a queue the downloads have all left.
+type dequeuedQueue struct {
+	Queue
+}
+
+func (q *dequeuedQueue) Remove(id string) (bool, error) {
+	return false, nil
+}
+
+func TestDeleteWaitsForRunningDownloadToStop(t *testing.T) {
+	running := &Download{ID: "running", URL: "http://example.com/data", State: StateRunning, Status: &Status{}}
+	store := &memoryStore{downloads: []*Download{running}}
+
+	s := NewDownloadService(store, &MemoryFileStore{}, &dequeuedQueue{}, 0, 0)
+	ctx, _ := s.cancellations.Start(running.ID)
+
+	deleted, err := s.Delete(running)
+	if err != nil || !deleted {
+		t.Fatalf("delete: expected deleted, got %v, %v", deleted, err)
+	}
+	if ctx.Err() == nil {
+		t.Errorf("cancel: expected the worker to be cancelled")
+	}
+	if d, _ := store.FindByID(running.ID); d == nil {
+		t.Fatalf("delete: expected the record kept until the worker stops")
+	}
+
+	s.ProcessError(NewError(running.ID, context.Canceled, time.Now()))
+	s.ProcessStatusUpdate(&StatusUpdate{DownloadID: running.ID, State: StateCancelled})
+	if d, _ := store.FindByID(running.ID); d != nil {
+		t.Errorf("delete: expected the record removed once the worker stopped")
+	}
+
+	// late updates for the deleted download are dropped rather than sent
+	// back to the handler
+	s.ProcessError(NewError(running.ID, errors.New("late"), time.Now()))
+	s.ProcessStatusUpdate(&StatusUpdate{DownloadID: running.ID, BytesRead: 1})
+}
+
+func TestDeleteRemovesDownloadThatFinishedFirst(t *testing.T) {
+	finishing := &Download{ID: "finishing", URL: "http://example.com/data", State: StateRunning, Status: &Status{}}
+	store := &memoryStore{downloads: []*Download{finishing}}
+
+	s := NewDownloadService(store, &MemoryFileStore{}, &dequeuedQueue{}, 0, 0)
+	s.cancellations.Start(finishing.ID)
+
+	// the worker's last update was handled before it let go of the
+	// download
+	stale := *finishing
+	finishing.State = StateSucceeded
+
+	deleted, err := s.Delete(&stale)
+	if err != nil || !deleted {
+		t.Fatalf("delete: expected deleted, got %v, %v", deleted, err)
+	}
+	if d, _ := store.FindByID(finishing.ID); d != nil {
+		t.Errorf("delete: expected the finished download removed")
+	}
+}
+
+// missingFileStore has no data for any download.
+type missingFileStore struct {
+	MemoryFileStore
+}
+
+func (s *missingFileStore) Delete(d *Download) (bool, error) {
+	return false, errors.New("no such file")
+}
+
+func TestDeleteSkipsDataNeverWritten(t *testing.T) {
+	downloads := []*Download{
+		{ID: "queued", State: StateQueued, StateHistory: []StateTransition{{State: StateQueued}}},
+		{ID: "cancelled", State: StateCancelled, StateHistory: []StateTransition{{State: StateRunning}, {State: StateCancelled}}},
+		{ID: "mismatched", State: StateSucceeded, ChecksumVerdict: ChecksumMismatched, StateHistory: []StateTransition{{State: StateRunning}, {State: StateSucceeded}}},
+	}
+	store := &memoryStore{downloads: downloads}
+
+	s := NewDownloadService(store, &missingFileStore{}, &dequeuedQueue{}, 0, 0)
+	s.DeleteOnChecksumMismatch = true
+
+	for _, d := range downloads {
+		// queued downloads are marked so a worker skips them
+		deleted, err := s.Delete(d)
+		if err != nil || !deleted {
+			t.Errorf("delete(%s): expected deleted, got %v, %v", d.ID, deleted, err)
+		}
+	}
+	if len(store.downloads) != 0 {
+		t.Errorf("records: expected none left, got %d", len(store.downloads))
+	}
+}
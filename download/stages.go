@@ -0,0 +1,398 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxExpandedSize limits how much data extracting or
+	// decompressing a download may produce.
+	DefaultMaxExpandedSize = 16 * 1024 * 1024 * 1024
+	// DefaultMaxExtractedFiles limits how many files extracting an archive
+	// may produce.
+	DefaultMaxExtractedFiles = 100000
+	// DefaultCommandTimeout ...
+	DefaultCommandTimeout = 30 * time.Minute
+)
+
+// ExpansionError is returned when extracting or decompressing produces
+// more than the stage allows, as an archive bomb would.
+type ExpansionError struct {
+	Limit uint64
+	Files bool
+}
+
+func (e ExpansionError) Error() string {
+	if e.Files {
+		return fmt.Sprintf("more than %d files", e.Limit)
+	}
+	return fmt.Sprintf("expands to more than %d bytes", e.Limit)
+}
+
+// expansion counts what has been written against the stage's limits.
+type expansion struct {
+	maxBytes uint64
+	maxFiles uint64
+	bytes    uint64
+	files    uint64
+}
+
+// create writes data to a new file at target.
+func (e *expansion) create(target string, data io.Reader) error {
+	e.files++
+	if e.maxFiles > 0 && e.files > e.maxFiles {
+		return ExpansionError{Limit: e.maxFiles, Files: true}
+	}
+
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if e.maxBytes > 0 {
+		data = io.LimitReader(data, int64(e.maxBytes-e.bytes)+1)
+	}
+	written, err := io.Copy(f, data)
+	e.bytes += uint64(written)
+	if err != nil {
+		return err
+	}
+	if e.maxBytes > 0 && e.bytes > e.maxBytes {
+		return ExpansionError{Limit: e.maxBytes}
+	}
+
+	return f.Close()
+}
+
+func readHeader(fileName string, size int) ([]byte, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, size)
+	n, err := io.ReadFull(f, header)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return header[:n], err
+}
+
+// ExtractStage unpacks zip and tar archives. Anything else is left alone,
+// so compressed archives need a DecompressStage first. Only regular files
+// are extracted.
+type ExtractStage struct {
+	MaxBytes uint64
+	MaxFiles uint64
+}
+
+// Name ...
+func (s *ExtractStage) Name() string {
+	return "extract"
+}
+
+// Run ...
+func (s *ExtractStage) Run(ctx context.Context, run *StageRun) error {
+	header, err := readHeader(run.Input, 262)
+	if err != nil {
+		return err
+	}
+
+	limits := &expansion{maxBytes: s.MaxBytes, maxFiles: s.MaxFiles}
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return s.extractZip(ctx, run, limits)
+	case len(header) == 262 && string(header[257:262]) == "ustar":
+		return s.extractTar(ctx, run, limits)
+	}
+	return nil
+}
+
+// extractPath returns where an entry goes, refusing names that would
+// escape the output directory.
+func extractPath(dir string, name string) (string, error) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("archive entry %q is outside the archive", name)
+	}
+	return target, nil
+}
+
+func (s *ExtractStage) extractZip(ctx context.Context, run *StageRun, limits *expansion) error {
+	archive, err := zip.OpenReader(run.Input)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for _, entry := range archive.File {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+
+		target, err := extractPath(run.Dir, entry.Name)
+		if err != nil {
+			return err
+		}
+		data, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = limits.create(target, data)
+		data.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *ExtractStage) extractTar(ctx context.Context, run *StageRun, limits *expansion) error {
+	f, err := os.Open(run.Input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	archive := tar.NewReader(f)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		entry, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		target, err := extractPath(run.Dir, entry.Name)
+		if err != nil {
+			return err
+		}
+		err = limits.create(target, archive)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compressedSuffixes map the extensions of compressed files to those of
+// what they decompress to.
+var compressedSuffixes = map[string]string{
+	".gz":    "",
+	".gzip":  "",
+	".bz2":   "",
+	".bzip2": "",
+	".tgz":   ".tar",
+	".tbz":   ".tar",
+	".tbz2":  ".tar",
+}
+
+// DecompressStage decompresses gzip and bzip2 data, handing the result to
+// the stages after it. Anything else is left alone.
+type DecompressStage struct {
+	MaxBytes uint64
+}
+
+// Name ...
+func (s *DecompressStage) Name() string {
+	return "decompress"
+}
+
+// Run ...
+func (s *DecompressStage) Run(ctx context.Context, run *StageRun) error {
+	header, err := readHeader(run.Input, 3)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(run.Input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var data io.Reader
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		data = gzipReader
+	case bytes.HasPrefix(header, []byte("BZh")):
+		data = bzip2.NewReader(f)
+	default:
+		return nil
+	}
+
+	name := decompressedName(run.Name)
+	target := filepath.Join(run.Dir, name)
+	limits := &expansion{maxBytes: s.MaxBytes}
+	err = limits.create(target, &contextReader{ctx: ctx, Reader: data})
+	if err != nil {
+		return err
+	}
+
+	run.Input = target
+	run.Name = name
+	return nil
+}
+
+func decompressedName(name string) string {
+	ext := filepath.Ext(name)
+	replacement, ok := compressedSuffixes[strings.ToLower(ext)]
+	if !ok || name == ext {
+		return name + ".decompressed"
+	}
+	return strings.TrimSuffix(name, ext) + replacement
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, r.ctx.Err()
+	}
+	return r.Reader.Read(p)
+}
+
+// ChecksumStage writes sidecar files in the format of sha256sum and
+// friends, one for each of Types, defaulting to the download's checksum
+// type.
+type ChecksumStage struct {
+	Types []string
+}
+
+// Name ...
+func (s *ChecksumStage) Name() string {
+	return "checksum"
+}
+
+// Run ...
+func (s *ChecksumStage) Run(ctx context.Context, run *StageRun) error {
+	types := s.Types
+	if len(types) == 0 {
+		types = []string{strings.ToLower(run.Download.ChecksumType)}
+	}
+
+	hashes := make([]hash.Hash, len(types))
+	writers := make([]io.Writer, len(types))
+	for i, checksumType := range types {
+		h, err := NewHash(checksumType)
+		if err != nil {
+			return err
+		}
+		hashes[i], writers[i] = h, h
+	}
+
+	f, err := os.Open(run.Input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(io.MultiWriter(writers...), &contextReader{ctx: ctx, Reader: f})
+	if err != nil {
+		return err
+	}
+
+	for i, checksumType := range types {
+		sidecar := fmt.Sprintf("%s  %s\n", hex.EncodeToString(hashes[i].Sum(nil)), run.Name)
+		err = ioutil.WriteFile(filepath.Join(run.Dir, run.Name+"."+checksumType), []byte(sidecar), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// maxCommandOutput is how much of a failed command's output is kept in
+// its error.
+const maxCommandOutput = 1024
+
+// CommandStage runs an external command in the stage's output directory.
+// It finds the download through DOWNLOAD_ environment variables, and any
+// files it leaves in DOWNLOAD_OUTPUT_DIR are kept as artifacts. Exiting
+// with a non-zero status fails the stage.
+type CommandStage struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration
+}
+
+// Name ...
+func (s *CommandStage) Name() string {
+	return "command"
+}
+
+// Run ...
+func (s *CommandStage) Run(ctx context.Context, run *StageRun) error {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, s.Path, s.Args...)
+	cmd.Dir = run.Dir
+	cmd.Env = append(os.Environ(),
+		"DOWNLOAD_ID="+run.Download.ID,
+		"DOWNLOAD_URL="+run.Download.URL,
+		"DOWNLOAD_FILE="+run.Input,
+		"DOWNLOAD_NAME="+run.Name,
+		"DOWNLOAD_CHECKSUM="+run.Download.Checksum,
+		"DOWNLOAD_CHECKSUM_TYPE="+run.Download.ChecksumType,
+		"DOWNLOAD_OUTPUT_DIR="+run.Dir)
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		output = bytes.TrimSpace(output)
+		if len(output) > maxCommandOutput {
+			output = output[len(output)-maxCommandOutput:]
+		}
+		return fmt.Errorf("%s: %v: %s", s.Path, err, output)
+	}
+
+	return nil
+}
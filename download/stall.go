@@ -0,0 +1,86 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StallPolicy aborts an attempt whose throughput stays below
+// MinBytesPerSecond for a whole Window. A zero Window never aborts, and a
+// zero MinBytesPerSecond only aborts attempts that make no progress at
+// all.
+type StallPolicy struct {
+	MinBytesPerSecond uint64
+	Window            time.Duration
+}
+
+// StallError is returned for an attempt aborted by the StallPolicy.
+type StallError struct {
+	BytesRead uint64
+	Window    time.Duration
+}
+
+func (e StallError) Error() string {
+	return fmt.Sprintf("stalled: %d bytes read in %v", e.BytesRead, e.Window)
+}
+
+// Timeout is true, so stalls are treated like other timeouts.
+func (e StallError) Timeout() bool {
+	return true
+}
+
+func (p *StallPolicy) stalled(bytesRead uint64) bool {
+	rate := float64(bytesRead) / p.Window.Seconds()
+	return bytesRead == 0 || rate < float64(p.MinBytesPerSecond)
+}
+
+// watch returns a context for one attempt, cancelled if the bytes counted
+// by statusWriter show the attempt has stalled. Calling stop ends the
+// watch and returns a StallError if that is why the attempt ended.
+func (p *StallPolicy) watch(ctx context.Context, statusWriter *StatusWriter) (attemptCtx context.Context, stop func() error) {
+	attemptCtx, cancel := context.WithCancel(ctx)
+	if p == nil || p.Window <= 0 {
+		return attemptCtx, func() error {
+			cancel()
+			return nil
+		}
+	}
+
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(p.Window)
+		defer ticker.Stop()
+
+		last := statusWriter.BytesRead()
+		for {
+			select {
+			case <-done:
+				result <- nil
+				return
+			case <-attemptCtx.Done():
+				result <- nil
+				return
+			case <-ticker.C:
+				current := statusWriter.BytesRead()
+				if current < last {
+					// the attempt started over
+					last = 0
+				}
+				if p.stalled(current - last) {
+					result <- StallError{BytesRead: current - last, Window: p.Window}
+					cancel()
+					return
+				}
+				last = current
+			}
+		}
+	}()
+
+	return attemptCtx, func() error {
+		close(done)
+		cancel()
+		return <-result
+	}
+}
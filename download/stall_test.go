@@ -0,0 +1,76 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveStalling sends the first bytes of testContent and then nothing
+// more until the client goes away.
+func serveStalling(release chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Length", "36")
+		rw.Write([]byte(testContent[:10]))
+		rw.(http.Flusher).Flush()
+
+		select {
+		case <-req.Context().Done():
+		case <-release:
+		}
+	}))
+}
+
+func TestSaveAbortsStalledAttempt(t *testing.T) {
+	release := make(chan struct{})
+	server := serveStalling(release)
+	defer server.Close()
+	defer close(release)
+
+	fileStore := &MemoryFileStore{}
+	sender := &RecordingStatusSender{}
+	w := createTestWorker(fileStore, sender)
+	w.StallPolicy = &StallPolicy{MinBytesPerSecond: 1, Window: 50 * time.Millisecond}
+
+	err := w.SaveWithStatus(context.Background(), &Download{
+		ID:           "some-dummy-downloadid",
+		URL:          server.URL,
+		ChecksumType: "sha256",
+		Status:       &Status{}})
+
+	var stallErr StallError
+	if !errors.As(err, &stallErr) {
+		t.Fatalf("error: expected stall, got %v", err)
+	}
+
+	e := <-w.ErrorChannel
+	if e.Kind != ErrorKindTimeout {
+		t.Errorf("kind: expected %s, got %s", ErrorKindTimeout, e.Kind)
+	}
+	if sender.Last().State != StateFailed {
+		t.Errorf("state: expected %s, got %s", StateFailed, sender.Last().State)
+	}
+}
+
+func TestIdleReadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := serveStalling(release)
+	defer server.Close()
+	defer close(release)
+
+	client := NewHTTPClient(&Transport{Timeouts: &Timeouts{IdleRead: 50 * time.Millisecond}}, nil)
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	_, err = io.ReadAll(res.Body)
+	if ErrorKind(err) != ErrorKindTimeout {
+		t.Errorf("kind: expected %s, got %s (%v)", ErrorKindTimeout, ErrorKind(err), err)
+	}
+}
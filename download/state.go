@@ -0,0 +1,61 @@
+package download
+
+import (
+	"fmt"
+	"time"
+)
+
+// State ...
+type State string
+
+const (
+	// StateQueued ...
+	StateQueued State = "queued"
+	// StateRunning ...
+	StateRunning State = "running"
+	// StateSucceeded ...
+	StateSucceeded State = "succeeded"
+	// StateFailed ...
+	StateFailed State = "failed"
+	// StateCancelled ...
+	StateCancelled State = "cancelled"
+)
+
+// stateTransitions lists the states each state can move to. Succeeded,
+// failed and cancelled downloads are finished and can't move anywhere.
+var stateTransitions = map[State][]State{
+	StateQueued: {StateRunning, StateFailed, StateCancelled},
+	// running downloads go back to queued when the service restarts
+	StateRunning: {StateQueued, StateSucceeded, StateFailed, StateCancelled},
+}
+
+// IsFinished ...
+func (s State) IsFinished() bool {
+	return s == StateSucceeded || s == StateFailed || s == StateCancelled
+}
+
+// CanTransition ...
+func (s State) CanTransition(to State) bool {
+	for _, allowed := range stateTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StateTransition ...
+type StateTransition struct {
+	State State
+	Time  time.Time
+}
+
+// StateError ...
+type StateError struct {
+	From State
+	To   State
+}
+
+func (e StateError) Error() string {
+	return fmt.Sprintf("invalid state transition from %s to %s", e.From, e.To)
+}
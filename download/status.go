@@ -7,10 +7,19 @@ import (
 type Status struct {
 	BytesRead  uint64
 	UpdateTime time.Time
+	// Segments is how many ranges the current attempt is fetching in
+	// parallel, or zero for a single sequential fetch.
+	Segments uint
 }
 
 func (s *Status) AddStatusUpdate(statusUpdate *StatusUpdate) {
-	s.BytesRead += statusUpdate.BytesRead
+	if statusUpdate.Started {
+		// a (re)started fetch reports how much data is already stored
+		s.BytesRead = statusUpdate.BytesRead
+		s.Segments = statusUpdate.Segments
+	} else {
+		s.BytesRead += statusUpdate.BytesRead
+	}
 	s.UpdateTime = statusUpdate.Time
 }
 
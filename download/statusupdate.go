@@ -9,5 +9,16 @@ type StatusUpdate struct {
 	BytesRead  uint64
 	Checksum   string
 	Time       time.Time
-	Finished   bool
+	Started    bool
+	Segments   uint
+	Proxy      string
+	State      State
+	Metadata   *Metadata
+	Stages     []StageResult
+	// Quarantined is set in the finished update of infected downloads
+	// moved to quarantine.
+	Quarantined bool
+	// Blob is set in the finished update of downloads moved into a
+	// content addressable file store.
+	Blob string
 }
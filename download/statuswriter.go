@@ -1,8 +1,12 @@
 package download
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"hash"
+	"io"
+	"sync"
 
 	"github.com/patdowney/downloaderd-common/common"
 )
@@ -17,6 +21,25 @@ type StatusWriter struct {
 	TotalBytesRead       int
 	UpdateByteDifference int
 	ByteCountToSend      int
+
+	// Segments is reported in the start update when the data is being
+	// fetched as several ranges in parallel.
+	Segments uint
+	// Proxy is reported in the start update, naming the proxy the data is
+	// fetched through.
+	Proxy string
+
+	// Stages is reported in the finished update, recording the processing
+	// stages run after the fetch.
+	Stages      []StageResult
+	Quarantined bool
+	Blob        string
+
+	// MaxBytes stops the download once more than this many bytes have been
+	// read. Zero means no limit.
+	MaxBytes uint64
+
+	mutex sync.Mutex
 }
 
 // NewStatusWriter ...
@@ -39,6 +62,18 @@ func (s *StatusWriter) Write(bytes []byte) (int, error) {
 	}
 	byteCount := len(bytes)
 
+	err := s.AddBytesRead(byteCount)
+
+	return byteCount, err
+}
+
+// AddBytesRead counts bytes without hashing them, returning a
+// SizeLimitError once more than MaxBytes have been read. It is safe to
+// call from several segments at once.
+func (s *StatusWriter) AddBytesRead(byteCount int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	s.TotalBytesRead += byteCount
 	s.ByteCountToSend += byteCount
 
@@ -47,32 +82,125 @@ func (s *StatusWriter) Write(bytes []byte) (int, error) {
 		s.ByteCountToSend = 0
 	}
 
+	if s.MaxBytes > 0 && uint64(s.TotalBytesRead) > s.MaxBytes {
+		return SizeLimitError{Size: uint64(s.TotalBytesRead), Limit: s.MaxBytes}
+	}
+	return nil
+}
+
+// BytesRead returns the number of bytes counted so far. It is safe to
+// call while the download is being written.
+func (s *StatusWriter) BytesRead() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return uint64(s.TotalBytesRead)
+}
+
+// HashData feeds data into the hash without counting it as read, for
+// downloads whose parts arrive out of order.
+func (s *StatusWriter) HashData(data io.Reader) (uint64, error) {
+	var w io.Writer = io.Discard
+	if s.Hash != nil {
+		w = s.Hash
+	}
+	byteCount, err := io.Copy(w, data)
+
+	return uint64(byteCount), err
+}
+
+// Resume seeds the hash and byte count with data already stored by an
+// earlier attempt, returning the number of bytes read.
+func (s *StatusWriter) Resume(existingData io.Reader) (uint64, error) {
+	s.Reset()
+	byteCount, err := s.HashData(existingData)
+	if err != nil {
+		s.Reset()
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.TotalBytesRead = int(byteCount)
+	s.ByteCountToSend = 0
+
 	return byteCount, nil
 }
 
+// Reset ...
+func (s *StatusWriter) Reset() {
+	if s.Hash != nil {
+		s.Hash.Reset()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.TotalBytesRead = 0
+	s.ByteCountToSend = 0
+}
+
 // SendBytesWrittenUpdate ...
 func (s *StatusWriter) SendBytesWrittenUpdate(byteCount uint64) {
-	s.SendUpdate(byteCount, false)
+	s.SendUpdate(byteCount, "")
 }
 
 // SendStartUpdate ...
 func (s *StatusWriter) SendStartUpdate() {
-	s.SendUpdate(uint64(0), false)
+	statusUpdate := s.newStatusUpdate(uint64(s.TotalBytesRead))
+	statusUpdate.Started = true
+	statusUpdate.Segments = s.Segments
+	statusUpdate.Proxy = s.Proxy
+
+	s.StatusSender.SendUpdate(statusUpdate)
+}
+
+// SendMetadataUpdate ...
+func (s *StatusWriter) SendMetadataUpdate(metadata *Metadata) {
+	statusUpdate := s.newStatusUpdate(uint64(0))
+	statusUpdate.Metadata = metadata
+
+	s.StatusSender.SendUpdate(statusUpdate)
 }
 
-// SendFinishedUpdate ...
-func (s *StatusWriter) SendFinishedUpdate() {
-	s.SendUpdate(uint64(s.ByteCountToSend), true)
+// SendStateUpdate ...
+func (s *StatusWriter) SendStateUpdate(state State) {
+	s.SendUpdate(uint64(0), state)
 }
 
-// SendUpdate ...
-func (s *StatusWriter) SendUpdate(byteCount uint64, finished bool) {
-	statusUpdate := StatusUpdate{
+// SendFinishedUpdate reports any bytes not yet sent along with the
+// outcome of the fetch.
+func (s *StatusWriter) SendFinishedUpdate(err error) {
+	state := StateSucceeded
+	if errors.Is(err, context.Canceled) {
+		state = StateCancelled
+	} else if err != nil {
+		state = StateFailed
+	}
+
+	statusUpdate := s.newStatusUpdate(uint64(s.ByteCountToSend))
+	statusUpdate.State = state
+	statusUpdate.Stages = s.Stages
+	statusUpdate.Quarantined = s.Quarantined
+	statusUpdate.Blob = s.Blob
+
+	s.StatusSender.SendUpdate(statusUpdate)
+	s.ByteCountToSend = 0
+}
+
+func (s *StatusWriter) newStatusUpdate(byteCount uint64) StatusUpdate {
+	return StatusUpdate{
 		DownloadID: s.DownloadID,
 		Checksum:   s.ChecksumString(),
 		Time:       s.Clock.Now(),
-		BytesRead:  byteCount,
-		Finished:   finished}
+		BytesRead:  byteCount}
+}
+
+// SendUpdate ...
+func (s *StatusWriter) SendUpdate(byteCount uint64, state State) {
+	statusUpdate := s.newStatusUpdate(byteCount)
+	statusUpdate.State = state
 
 	s.StatusSender.SendUpdate(statusUpdate)
 }
@@ -90,9 +218,3 @@ func (s *StatusWriter) Checksum() []byte {
 func (s *StatusWriter) ChecksumString() string {
 	return hex.EncodeToString(s.Checksum())
 }
-
-// Close ...
-func (s *StatusWriter) Close() error {
-	s.SendFinishedUpdate()
-	return nil
-}
@@ -8,8 +8,18 @@ type Store interface {
 	FindByID(string) (*Download, error)
 	FindByResourceKey(ResourceKey) (*Download, error)
 	FindAll(uint, uint) ([]*Download, error)
-	FindFinished(uint, uint) ([]*Download, error)
+	FindByState(State, uint, uint) ([]*Download, error)
 	FindNotFinished(uint, uint) ([]*Download, error)
-	FindInProgress(uint, uint) ([]*Download, error)
-	FindWaiting(uint, uint) ([]*Download, error)
+	// FindVersions returns downloads of the URL, newest version first.
+	FindVersions(string, uint, uint) ([]*Download, error)
+	// FindByChecksum returns succeeded downloads whose data has the
+	// checksum of the given type.
+	FindByChecksum(string, string, uint, uint) ([]*Download, error)
+	// AddSource records another source URL of a download in one step,
+	// so concurrent requests and status updates don't lose it, and
+	// returns the download as stored.
+	AddSource(string, string) (*Download, error)
+	// SetBlob records the blob a download's data was moved into in one
+	// step, so the record never lags behind the blob's references.
+	SetBlob(string, string) error
 }
@@ -0,0 +1,215 @@
+package download
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// ClientCertificate is presented to hosts matching Pattern, either a host
+// name or a wildcard such as "*.example.com", when they ask for one.
+type ClientCertificate struct {
+	Pattern     string
+	Certificate tls.Certificate
+}
+
+// ParseClientCertificate reads pattern=cert-file,key-file and loads the
+// PEM encoded pair.
+func ParseClientCertificate(value string) (ClientCertificate, error) {
+	parts := strings.SplitN(value, "=", 2)
+	files := []string{}
+	if len(parts) == 2 {
+		files = strings.Split(parts[1], ",")
+	}
+	if len(files) != 2 || parts[0] == "" {
+		return ClientCertificate{}, fmt.Errorf("client certificate %q: expected pattern=cert-file,key-file", value)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(files[0], files[1])
+	if err != nil {
+		return ClientCertificate{}, fmt.Errorf("client certificate %q: %v", value, err)
+	}
+
+	return ClientCertificate{Pattern: strings.ToLower(parts[0]), Certificate: certificate}, nil
+}
+
+// Pin requires hosts matching Pattern to present a chain containing a key
+// whose SPKI hash is one of Hashes.
+type Pin struct {
+	Pattern string
+	Hashes  []string
+}
+
+// ParsePin reads pattern=hash[,hash], where each hash is the base64 SHA-256
+// of a DER encoded SubjectPublicKeyInfo, optionally prefixed "sha256/".
+func ParsePin(value string) (Pin, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Pin{}, fmt.Errorf("pin %q: expected pattern=hash[,hash]", value)
+	}
+	pin := Pin{Pattern: strings.ToLower(parts[0])}
+
+	for _, hash := range strings.Split(parts[1], ",") {
+		hash = strings.TrimPrefix(hash, "sha256/")
+		decoded, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil || len(decoded) != sha256.Size {
+			return Pin{}, fmt.Errorf("pin %q: %q is not a base64 sha256 hash", value, hash)
+		}
+		pin.Hashes = append(pin.Hashes, hash)
+	}
+
+	return pin, nil
+}
+
+// SPKIHash returns the base64 SHA-256 hash of the certificate's public
+// key, as used by Pin.
+func SPKIHash(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// PinError is returned when a pinned host's certificates don't include
+// any of its pinned keys.
+type PinError struct {
+	Host string
+}
+
+func (e PinError) Error() string {
+	return fmt.Sprintf("tls: no certificate presented by %s matches its pinned keys", e.Host)
+}
+
+// LoadCertPool returns the system roots along with the certificates in
+// the PEM bundles given.
+func LoadCertPool(bundles []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	for _, bundle := range bundles {
+		data, err := ioutil.ReadFile(bundle)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("ca bundle %s: no certificates found", bundle)
+		}
+	}
+
+	return pool, nil
+}
+
+// TLSConfig holds the TLS settings for outbound requests. A nil RootCAs
+// means the system roots.
+type TLSConfig struct {
+	RootCAs            *x509.CertPool
+	ClientCertificates []ClientCertificate
+	Pins               []Pin
+}
+
+func (c *TLSConfig) clientCertificateFor(host string) *ClientCertificate {
+	if c == nil {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	i := bestHostMatch(host, len(c.ClientCertificates), func(i int) string {
+		return c.ClientCertificates[i].Pattern
+	})
+	if i < 0 {
+		return nil
+	}
+	return &c.ClientCertificates[i]
+}
+
+func (c *TLSConfig) pinFor(host string) *Pin {
+	if c == nil {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	i := bestHostMatch(host, len(c.Pins), func(i int) string {
+		return c.Pins[i].Pattern
+	})
+	if i < 0 {
+		return nil
+	}
+	return &c.Pins[i]
+}
+
+// verify runs after the usual chain verification, so the chains checked
+// have already been found to lead to a trusted root.
+func (p *Pin) verify(state tls.ConnectionState) error {
+	for _, chain := range state.VerifiedChains {
+		for _, certificate := range chain {
+			hash := SPKIHash(certificate)
+			for _, pinned := range p.Hashes {
+				if hash == pinned {
+					return nil
+				}
+			}
+		}
+	}
+
+	host := state.ServerName
+	if host == "" {
+		host = p.Pattern
+	}
+	return PinError{Host: host}
+}
+
+// clientConfig returns the tls.Config for connections presenting
+// certificate and checking pin, either of which may be nil.
+func (c *TLSConfig) clientConfig(certificate *ClientCertificate, pin *Pin) *tls.Config {
+	if c == nil {
+		return nil
+	}
+
+	config := &tls.Config{RootCAs: c.RootCAs}
+	if certificate != nil {
+		config.Certificates = []tls.Certificate{certificate.Certificate}
+	}
+	if pin != nil {
+		config.VerifyConnection = pin.verify
+	}
+
+	return config
+}
+
+// IsTLSVerificationError reports whether err is the origin's certificate
+// failing verification: an unknown authority, an invalid or expired
+// certificate, the wrong host name, or a pinning failure.
+func IsTLSVerificationError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var pin PinError
+
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &pin)
+}
+
+// IsTLSError reports whether err comes from a TLS handshake, such as the
+// origin rejecting the client certificate.
+func IsTLSError(err error) bool {
+	if IsTLSVerificationError(err) {
+		return true
+	}
+
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) {
+		return true
+	}
+
+	// alerts sent by the origin come wrapped like this
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
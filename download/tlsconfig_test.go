@@ -0,0 +1,79 @@
+package download
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serverPool(server *httptest.Server) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return pool
+}
+
+func TestTLSVerificationErrorKind(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	client := NewHTTPClient(&Transport{TLS: &TLSConfig{}}, nil)
+	_, err := client.Get(server.URL)
+	if ErrorKind(err) != ErrorKindTLSVerification {
+		t.Errorf("kind: expected %s, got %s (%v)", ErrorKindTLSVerification, ErrorKind(err), err)
+	}
+	if IsRetryable(err) {
+		t.Errorf("retryable: expected verification failure not to be retried")
+	}
+
+	client = NewHTTPClient(&Transport{TLS: &TLSConfig{RootCAs: serverPool(server)}}, nil)
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("get: expected trusted server, got %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestTLSPinning(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	wrong, _ := ParsePin("127.0.0.1=sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
+	client := NewHTTPClient(&Transport{TLS: &TLSConfig{RootCAs: serverPool(server), Pins: []Pin{wrong}}}, nil)
+	_, err := client.Get(server.URL)
+	if ErrorKind(err) != ErrorKindTLSVerification {
+		t.Errorf("kind: expected %s, got %s (%v)", ErrorKindTLSVerification, ErrorKind(err), err)
+	}
+
+	right := Pin{Pattern: "127.0.0.1", Hashes: []string{SPKIHash(server.Certificate())}}
+	client = NewHTTPClient(&Transport{TLS: &TLSConfig{RootCAs: serverPool(server), Pins: []Pin{right}}}, nil)
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("get: expected pinned key to match, got %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewHTTPClient(&Transport{TLS: &TLSConfig{RootCAs: serverPool(server)}}, nil)
+	_, err := client.Get(server.URL)
+	if ErrorKind(err) != ErrorKindTLS {
+		t.Errorf("kind: expected %s, got %s (%v)", ErrorKindTLS, ErrorKind(err), err)
+	}
+
+	certificate := ClientCertificate{Pattern: "127.0.0.1", Certificate: server.TLS.Certificates[0]}
+	client = NewHTTPClient(&Transport{TLS: &TLSConfig{
+		RootCAs:            serverPool(server),
+		ClientCertificates: []ClientCertificate{certificate}}}, nil)
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("get: expected client certificate to be accepted, got %v", err)
+	}
+	res.Body.Close()
+}
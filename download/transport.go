@@ -0,0 +1,204 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts limit each stage of an outbound request. Zero values keep the
+// defaults of http.DefaultTransport, which has no ResponseHeader or
+// IdleRead timeout.
+type Timeouts struct {
+	Connect        time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+	// IdleRead is how long a read of the response body may wait for
+	// data.
+	IdleRead time.Duration
+}
+
+// IdleTimeoutError is returned by a response body that waited longer than
+// the IdleRead timeout for data.
+type IdleTimeoutError struct {
+	After time.Duration
+}
+
+func (e IdleTimeoutError) Error() string {
+	return fmt.Sprintf("no data received for %v", e.After)
+}
+
+// Timeout ...
+func (e IdleTimeoutError) Timeout() bool {
+	return true
+}
+
+// idleTimeoutBody closes the body when a read waits too long, which
+// unblocks the read.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut int32
+}
+
+func (b *idleTimeoutBody) expire() {
+	atomic.StoreInt32(&b.timedOut, 1)
+	b.ReadCloser.Close()
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.timeout, b.expire)
+	} else {
+		b.timer.Reset(b.timeout)
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+
+	if atomic.LoadInt32(&b.timedOut) == 1 {
+		return n, IdleTimeoutError{After: b.timeout}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return b.ReadCloser.Close()
+}
+
+// Transport sends each request with the proxy and TLS settings for its
+// host. Hosts with the same proxy, client certificate and pin share
+// connections. Requests sent direct only connect to addresses allowed by
+// Addresses; those sent through a proxy connect to nothing but the proxy.
+type Transport struct {
+	Proxies   *ProxyConfig
+	TLS       *TLSConfig
+	Timeouts  *Timeouts
+	Addresses *AddressPolicy
+
+	sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// NewHTTPClient returns a client sending requests through transport,
+// following the redirects allowed by redirects.
+func NewHTTPClient(transport *Transport, redirects *RedirectPolicy) *http.Client {
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: redirects.CheckRedirect}
+}
+
+func (t *Transport) newTransport(proxy *url.URL, certificate *ClientCertificate, pin *Pin) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.TLSClientConfig = t.TLS.clientConfig(certificate, pin)
+
+	// the same as http.DefaultTransport's dialer
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if t.Timeouts != nil && t.Timeouts.Connect > 0 {
+		dialer.Timeout = t.Timeouts.Connect
+	}
+	if proxy != nil {
+		// the only connection made is to the configured proxy
+		transport.Proxy = http.ProxyURL(proxy)
+		transport.DialContext = dialer.DialContext
+	} else {
+		transport.DialContext = t.dialContext(dialer)
+	}
+
+	if t.Timeouts != nil {
+		if t.Timeouts.TLSHandshake > 0 {
+			transport.TLSHandshakeTimeout = t.Timeouts.TLSHandshake
+		}
+		transport.ResponseHeaderTimeout = t.Timeouts.ResponseHeader
+	}
+
+	return transport
+}
+
+func (t *Transport) dialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	if t.Addresses == nil {
+		return dialer.DialContext
+	}
+
+	guarded := *dialer
+	guarded.Control = t.Addresses.Control
+
+	return guarded.DialContext
+}
+
+func (t *Transport) transportFor(host string, proxy *url.URL) *http.Transport {
+	certificate := t.TLS.clientCertificateFor(host)
+	pin := t.TLS.pinFor(host)
+
+	key := "|"
+	if proxy != nil {
+		key = proxy.String() + key
+	}
+	key += "|"
+	if certificate != nil {
+		key = certificate.Pattern + key
+	}
+	if pin != nil {
+		key += pin.Pattern
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.transports == nil {
+		t.transports = make(map[string]*http.Transport)
+	}
+
+	transport, ok := t.transports[key]
+	if !ok {
+		transport = t.newTransport(proxy, certificate, pin)
+		t.transports[key] = transport
+	}
+
+	return transport
+}
+
+// RoundTrip ...
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a proxy connects on our behalf, so the best that can be done is to
+	// check where the host resolves to now
+	proxy := t.Proxies.ProxyFor(req.URL)
+	if t.Addresses != nil && proxy != nil {
+		err := t.Addresses.CheckHost(req.Context(), req.URL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := t.transportFor(req.URL.Hostname(), proxy).RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Timeouts != nil && t.Timeouts.IdleRead > 0 {
+		res.Body = &idleTimeoutBody{ReadCloser: res.Body, timeout: t.Timeouts.IdleRead}
+	}
+
+	return res, nil
+}
+
+// CloseIdleConnections ...
+func (t *Transport) CloseIdleConnections() {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, transport := range t.transports {
+		transport.CloseIdleConnections()
+	}
+}
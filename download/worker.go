@@ -2,9 +2,13 @@ package download
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/patdowney/downloaderd-common/common"
@@ -13,12 +17,32 @@ import (
 // UpdateByteDifference ...
 const UpdateByteDifference = 50000
 
+// DefaultMinSegmentSize is the smallest range worth fetching on its own
+// connection.
+const DefaultMinSegmentSize = 4 * 1024 * 1024
+
 // HTTPError ...
 type HTTPError struct {
 	URL        string
 	Method     string
 	StatusCode int
 	Status     string
+	RetryAfter time.Duration
+}
+
+// NewHTTPError ...
+func NewHTTPError(method string, res *http.Response) HTTPError {
+	e := HTTPError{
+		URL:        res.Request.URL.String(),
+		Method:     method,
+		Status:     res.Status,
+		StatusCode: res.StatusCode}
+
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		e.RetryAfter = ParseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	}
+
+	return e
 }
 
 func (e HTTPError) Error() string {
@@ -27,27 +51,112 @@ func (e HTTPError) Error() string {
 
 // Worker ...
 type Worker struct {
-	ID           uint
-	Clock        common.Clock
-	FileStore    FileStore
-	WorkQueue    chan Download
-	ErrorChannel chan Error
-	StatusSender StatusSender
-	stop         bool
+	ID            uint
+	Clock         common.Clock
+	FileStore     FileStore
+	Queue         Queue
+	DownloadStore Store
+	ErrorChannel  chan Error
+	StatusSender  StatusSender
+	stop          bool
+
+	SegmentCount   uint
+	MinSegmentSize uint64
+	RetryPolicy    *RetryPolicy
+	Cancellations  *Cancellations
+	HostLimiter    *HostLimiter
+	RateLimiter    *RateLimiter
+	// Preflight sends a HEAD request so metadata is known before the
+	// first GET.
+	Preflight bool
+	Fetchers  map[string]Fetcher
+
+	Credentials *Credentials
+	// HTTPClient sends the worker's own HEAD and range requests. A nil
+	// HTTPClient means http.DefaultClient.
+	HTTPClient *http.Client
+	// Proxies is what HTTPClient chooses proxies by, so the one used can
+	// be recorded.
+	Proxies     *ProxyConfig
+	StallPolicy *StallPolicy
+	Limits      *Limits
+	Pipeline    *Pipeline
+}
+
+func (w Worker) httpClient() *http.Client {
+	if w.HTTPClient != nil {
+		return w.HTTPClient
+	}
+	return http.DefaultClient
 }
 
 func (w Worker) start() {
 	go func() {
 		for {
-			download := <-w.WorkQueue
-			w.SaveWithStatus(&download)
+			item, err := w.Queue.Pop(w.claim)
+			if err != nil {
+				log.Printf("worker-dequeue-error(%d): %v", w.ID, err)
+			}
+			if item.DownloadID == "" {
+				continue
+			}
+
+			w.process(item)
+			w.HostLimiter.Release(item.Host)
 		}
 	}()
 }
 
+// claim accepts the first queued item whose host has a free slot, so one
+// busy origin doesn't hold up downloads from the others.
+func (w Worker) claim(item QueueItem) bool {
+	return w.HostLimiter.TryAcquire(item.Host)
+}
+
+func (w Worker) process(item QueueItem) {
+	download, err := w.find(item)
+	if err != nil {
+		log.Printf("worker-dequeue-error(%d): %v", w.ID, err)
+		return
+	}
+	if download == nil || download.IsFinished() {
+		return
+	}
+
+	ctx, ok := w.Cancellations.Start(download.ID)
+	if !ok {
+		// cancelled while it was queued
+		return
+	}
+	w.SaveWithStatus(ctx, download)
+	w.Cancellations.Finish(download.ID)
+}
+
+// find returns this worker's copy of the queued download.
+func (w Worker) find(item QueueItem) (*Download, error) {
+	queued, err := w.DownloadStore.FindByID(item.DownloadID)
+	if err != nil || queued == nil {
+		return nil, err
+	}
+
+	download := *queued
+	download.Auth = w.Credentials.For(&download)
+
+	return &download, nil
+}
+
+// throttle limits reads to the worker's global rate and to the rate
+// requested for the download.
+func (w Worker) throttle(ctx context.Context, dataReader io.Reader) io.Reader {
+	return &ThrottledReader{
+		Reader:   dataReader,
+		Context:  ctx,
+		Limiters: []*RateLimiter{w.RateLimiter, downloadLimiter(ctx)}}
+}
+
 // WriteData ...
-func (w Worker) WriteData(dataReader io.Reader, outputWriter io.Writer, statusWriter *StatusWriter) error {
-	teeReader := io.TeeReader(dataReader, statusWriter)
+func (w Worker) WriteData(ctx context.Context, dataReader io.Reader, outputWriter io.Writer, statusWriter *StatusWriter) error {
+	teeReader := io.TeeReader(w.throttle(ctx, dataReader), statusWriter)
 
 	_, err := io.Copy(outputWriter, teeReader)
 	if err != nil {
@@ -59,77 +168,444 @@ func (w Worker) WriteData(dataReader io.Reader, outputWriter io.Writer, statusWr
 
 // SendError ...
 func (w Worker) SendError(id string, err error) {
-	e := Error{DownloadID: id}
+	w.SendAttemptError(id, 0, err)
+}
+
+// SendAttemptError ...
+func (w Worker) SendAttemptError(id string, attempt uint, err error) {
+	e := Error{DownloadID: id, Attempt: attempt, Kind: ErrorKind(err)}
 	e.Time = w.Clock.Now()
 	e.OriginalError = err.Error()
 
 	w.ErrorChannel <- e
 }
 
-// SaveWithStatus ...
-func (w Worker) SaveWithStatus(download *Download) error {
+// SaveWithStatus fetches the download, retrying transient failures as
+// allowed by the worker's RetryPolicy. Every failed attempt is reported.
+func (w Worker) SaveWithStatus(ctx context.Context, download *Download) error {
 	downloadHash, err := download.Hash()
 	if err != nil {
 		w.SendError(download.ID, err)
 	}
 
+	// what this worker learns about the origin stays with its copy
+	metadata := Metadata{}
+	if download.Metadata != nil {
+		metadata = *download.Metadata
+	}
+	download.Metadata = &metadata
+
+	if download.MaxBytesPerSecond > 0 {
+		ctx = withDownloadLimiter(ctx, NewRateLimiter(download.MaxBytesPerSecond))
+	}
+
 	statusWriter := NewStatusWriter(download.ID, w.StatusSender, downloadHash, UpdateByteDifference)
-	defer statusWriter.Close()
+	if IsHTTP(download.URL) {
+		statusWriter.Proxy = w.Proxies.Describe(download.URL)
+	}
+	statusWriter.MaxBytes = w.Limits.MaxSizeFor(download)
+	statusWriter.SendStateUpdate(StateRunning)
+
+	if w.Preflight && IsHTTP(download.URL) {
+		err = w.preflight(ctx, download, statusWriter)
+		if err != nil {
+			log.Printf("preflight-error(%s): %v", download.ID, err)
+		}
+	}
 
-	outputWriter, err := w.FileStore.GetWriter(download)
+	err = w.saveWithRetries(ctx, download, statusWriter)
+	if err == nil && download.checksumMatches(statusWriter.ChecksumString()) {
+		if w.Pipeline.Enabled() {
+			err = w.runPipeline(ctx, download, statusWriter)
+		}
+		if err == nil {
+			w.commit(download, statusWriter)
+		}
+	}
+	statusWriter.SendFinishedUpdate(err)
+
+	return err
+}
+
+// runPipeline runs the pipeline over the fetched data. Data that doesn't
+// match its requested checksum is never processed.
+func (w Worker) runPipeline(ctx context.Context, download *Download, statusWriter *StatusWriter) error {
+	download.Checksum = statusWriter.ChecksumString()
+
+	stages, err := w.Pipeline.Run(ctx, download, w.FileStore, w.Clock)
+	statusWriter.Stages = stages
 	if err != nil {
 		w.SendError(download.ID, err)
+	}
+
+	var infected InfectedError
+	if errors.As(err, &infected) {
+		statusWriter.Quarantined = w.quarantine(download)
+	}
+
+	return err
+}
+
+// commit moves the data into the file store's blob for its content, if
+// the store keeps blobs. Data that can't be moved stays where it is.
+func (w Worker) commit(download *Download, statusWriter *StatusWriter) {
+	store, ok := w.FileStore.(BlobStore)
+	if !ok || !store.StoresBlobs() {
+		return
+	}
+
+	checksum, err := contentChecksum(download, w.FileStore, statusWriter)
+	if err == nil {
+		err = store.Commit(download, checksum)
+	}
+	if err != nil {
+		log.Printf("blob-commit-error(%s): %v", download.ID, err)
+		return
+	}
+
+	// the data has left its own path, so the record has to say where it
+	// went before anything else reads or deletes it
+	err = w.DownloadStore.SetBlob(download.ID, checksum)
+	if err != nil {
+		log.Printf("blob-record-error(%s): %v", download.ID, err)
+	}
+
+	download.Blob = checksum
+	statusWriter.Blob = checksum
+}
+
+// quarantine moves infected data aside, reporting whether it could.
+func (w Worker) quarantine(download *Download) bool {
+	store, ok := w.FileStore.(QuarantineStore)
+	if !ok {
+		log.Printf("quarantine-unsupported(%s): data left in place", download.ID)
+		return false
+	}
+
+	err := store.Quarantine(download)
+	if err != nil {
+		log.Printf("quarantine-error(%s): %v", download.ID, err)
+		return false
+	}
+
+	download.Quarantined = true
+	return true
+}
+
+// preflight fills in the download's metadata from a HEAD request. Origins
+// that don't answer HEAD properly are left for the GET to describe.
+func (w Worker) preflight(ctx context.Context, download *Download, statusWriter *StatusWriter) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", download.URL, nil)
+	if err != nil {
+		return err
+	}
+	req = download.Auth.Apply(req)
+
+	res, err := w.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return NewHTTPError("Head", res)
+	}
+
+	metadata := MetadataFromResponse(res, w.Clock.Now())
+	download.Metadata.Update(metadata)
+	statusWriter.SendMetadataUpdate(metadata)
+
+	return nil
+}
+
+func (w Worker) saveWithRetries(ctx context.Context, download *Download, statusWriter *StatusWriter) error {
+	for attempt := uint(1); ; attempt++ {
+		err := w.SaveAttempt(ctx, download, statusWriter)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		w.SendAttemptError(download.ID, attempt, err)
+		if !w.RetryPolicy.ShouldRetry(attempt, err) {
+			return err
+		}
+
+		backoff := w.RetryPolicy.Backoff(attempt, err)
+		log.Printf("retry-download(%s): attempt %d failed, retrying in %v: %v", download.ID, attempt, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SaveAttempt makes a single attempt at fetching the download, continuing
+// from data already stored when that's possible.
+func (w Worker) SaveAttempt(ctx context.Context, download *Download, statusWriter *StatusWriter) error {
+	ctx, stopWatching := w.StallPolicy.watch(ctx, statusWriter)
+
+	err := w.saveAttempt(ctx, download, statusWriter)
+	if stallErr := stopWatching(); stallErr != nil {
+		return stallErr
+	}
+	return err
+}
+
+func (w Worker) saveAttempt(ctx context.Context, download *Download, statusWriter *StatusWriter) error {
+	var offset uint64
+	if download.Resumable() && statusWriter.Segments <= 1 {
+		var err error
+		offset, err = w.ResumeStatus(download, statusWriter)
+		if err != nil {
+			log.Printf("resume-status-error(%s): %v", download.ID, err)
+		}
+	} else {
+		statusWriter.Reset()
+	}
+
+	// only HTTP origins can be asked for ranges in parallel
+	segments := w.segmentCount(download)
+	if offset == 0 && segments > 1 && IsHTTP(download.URL) {
+		if fileStore, ok := w.FileStore.(SegmentedFileStore); ok {
+			return w.SaveSegmented(ctx, download, segments, fileStore, statusWriter)
+		}
+	}
+
+	return w.Save(ctx, download, offset, statusWriter)
+}
+
+func (w Worker) segmentCount(download *Download) uint {
+	if download.Segments > 0 {
+		return download.Segments
+	}
+	return w.SegmentCount
+}
+
+// ResumeStatus rebuilds the hash over the data an earlier attempt
+// already wrote and returns the offset to continue from.
+func (w Worker) ResumeStatus(download *Download, statusWriter *StatusWriter) (uint64, error) {
+	existingData, err := w.FileStore.GetReader(download)
+	if err != nil {
+		return 0, err
+	}
+	defer existingData.Close()
+
+	return statusWriter.Resume(existingData)
+}
+
+// Save ...
+func (w Worker) Save(ctx context.Context, download *Download, offset uint64, statusWriter *StatusWriter) error {
+	download.TimeStarted = w.Clock.Now()
+
+	fetcher, err := w.fetcher(download)
+	if err != nil {
+		return err
+	}
+
+	source, err := fetcher.Fetch(ctx, download, offset)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if source.Offset != offset {
+		// the origin sent the whole thing, so start over
+		offset = 0
+		statusWriter.Reset()
+	}
+
+	bufferedReader := bufio.NewReader(source)
+
+	// stores such as S3 need the size and type before the body arrives
+	metadata := source.Metadata
+	if metadata.MimeType == "" && offset == 0 && w.Limits.ChecksTypes() {
+		metadata.MimeType = sniffMimeType(bufferedReader)
+	}
+	download.Metadata.Update(metadata)
+
+	err = w.Limits.Admit(download, metadata)
+	if err != nil {
+		statusWriter.SendMetadataUpdate(metadata)
+		return err
+	}
+
+	outputWriter, err := w.getOutputWriter(download, offset)
+	if err != nil {
 		return err
 	}
 	defer outputWriter.Close()
 
+	statusWriter.Segments = 0
 	statusWriter.SendStartUpdate()
+	statusWriter.SendMetadataUpdate(metadata)
 
-	return w.Save(download, outputWriter, statusWriter)
+	return w.WriteData(ctx, bufferedReader, outputWriter, statusWriter)
 }
 
-// Save ...
-func (w Worker) Save(download *Download, outputWriter io.Writer, statusWriter *StatusWriter) error {
-	download.TimeStarted = time.Now()
+func (w Worker) fetcher(download *Download) (Fetcher, error) {
+	scheme := Scheme(download.URL)
+
+	fetcher, ok := w.Fetchers[scheme]
+	if !ok {
+		return nil, UnsupportedSchemeError{Scheme: scheme}
+	}
+	return fetcher, nil
+}
+
+func (w Worker) getOutputWriter(download *Download, offset uint64) (io.WriteCloser, error) {
+	if offset > 0 {
+		return w.FileStore.GetResumeWriter(download, offset)
+	}
+	return w.FileStore.GetWriter(download)
+}
+
+// SaveSegmented splits the download into ranges fetched in parallel when
+// the origin advertises byte ranges and a length that makes it worthwhile.
+// Otherwise it falls back to a single sequential fetch.
+func (w Worker) SaveSegmented(ctx context.Context, download *Download, segments uint, fileStore SegmentedFileStore, statusWriter *StatusWriter) error {
+	download.TimeStarted = w.Clock.Now()
 
-	res, err := http.Get(download.URL)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", download.URL, nil)
 	if err != nil {
-		w.SendError(download.ID, err)
 		return err
 	}
+	req = download.Auth.Apply(req)
 
-	if res.StatusCode != http.StatusOK {
-		err = HTTPError{
-			URL:        download.URL,
-			Method:     "Get",
-			Status:     res.Status,
-			StatusCode: res.StatusCode}
+	res, err := w.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
 
-		w.SendError(download.ID, err)
+	if res.StatusCode != http.StatusOK ||
+		res.Header.Get("Accept-Ranges") != "bytes" ||
+		res.ContentLength < int64(segments) ||
+		res.ContentLength < int64(segments)*int64(w.MinSegmentSize) {
+		return w.Save(ctx, download, 0, statusWriter)
+	}
+	size := uint64(res.ContentLength)
+	metadata := MetadataFromResponse(res, w.Clock.Now())
+	download.Metadata.Update(metadata)
+
+	err = w.Limits.Admit(download, metadata)
+	if err != nil {
+		statusWriter.SendMetadataUpdate(metadata)
 		return err
 	}
 
-	fetchedBody := res.Body
-	defer fetchedBody.Close()
+	outputWriter, err := fileStore.GetWriterAt(download)
+	if err != nil {
+		return err
+	}
+	defer outputWriter.Close()
+
+	statusWriter.Segments = segments
+	statusWriter.SendStartUpdate()
+	statusWriter.SendMetadataUpdate(metadata)
+
+	segmentErrors := make(chan error, segments)
+	var wg sync.WaitGroup
 
-	bufferedReader := bufio.NewReader(fetchedBody)
-	err = w.WriteData(bufferedReader, outputWriter, statusWriter)
+	segmentSize := size / uint64(segments)
+	for i := uint64(0); i < uint64(segments); i++ {
+		start := i * segmentSize
+		end := start + segmentSize - 1
+		if i == uint64(segments)-1 {
+			end = size - 1
+		}
+
+		wg.Add(1)
+		go func(start uint64, end uint64) {
+			defer wg.Done()
+			segmentErrors <- w.fetchSegment(ctx, download, metadata.RangeValidator(), start, end, outputWriter, statusWriter)
+		}(start, end)
+	}
+	wg.Wait()
+	close(segmentErrors)
+
+	for err := range segmentErrors {
+		if err != nil {
+			return err
+		}
+	}
+
+	// segments arrive out of order, so the checksum is taken afterwards
+	storedData, err := w.FileStore.GetReader(download)
 	if err != nil {
-		w.SendError(download.ID, err)
+		return err
 	}
+	defer storedData.Close()
+
+	_, err = statusWriter.HashData(storedData)
 
 	return err
 }
 
+func (w Worker) fetchSegment(ctx context.Context, download *Download, validator string, start uint64, end uint64, output io.WriterAt, statusWriter *StatusWriter) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", download.URL, nil)
+	if err != nil {
+		return err
+	}
+	req = download.Auth.Apply(req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+
+	res, err := w.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusPartialContent {
+		return NewHTTPError("Get", res)
+	}
+
+	contentRange, err := ParseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if contentRange.Start != start || contentRange.End != end {
+		return fmt.Errorf("segment mismatch: requested %d-%d, got %d-%d", start, end, contentRange.Start, contentRange.End)
+	}
+
+	segmentWriter := &SegmentWriter{
+		Output:       output,
+		Offset:       int64(start),
+		StatusWriter: statusWriter}
+
+	_, err = io.Copy(segmentWriter, w.throttle(ctx, bufio.NewReader(res.Body)))
+	if err != nil {
+		return err
+	}
+
+	if uint64(segmentWriter.Offset) != end+1 {
+		return io.ErrUnexpectedEOF
+	}
+
+	return nil
+}
+
 // NewWorker ...
-func NewWorker(id uint, workQueue chan Download, updateChannel chan StatusUpdate, errorChannel chan Error, fileStore FileStore) *Worker {
+func NewWorker(id uint, queue Queue, downloadStore Store, updateChannel chan StatusUpdate, errorChannel chan Error, fileStore FileStore) *Worker {
+	clock := &common.RealClock{}
 	worker := &Worker{
-		Clock:        &common.RealClock{},
-		ID:           id,
-		WorkQueue:    workQueue,
-		StatusSender: &ChannelStatusSender{StatusChannel: updateChannel},
-		ErrorChannel: errorChannel,
-		FileStore:    fileStore}
+		Clock:         clock,
+		ID:            id,
+		Queue:         queue,
+		DownloadStore: downloadStore,
+		StatusSender:  &ChannelStatusSender{StatusChannel: updateChannel},
+		ErrorChannel:  errorChannel,
+		FileStore:     fileStore,
+		Fetchers:      DefaultFetchers(nil, clock),
+
+		MinSegmentSize: DefaultMinSegmentSize}
 
 	return worker
 }
@@ -0,0 +1,295 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patdowney/downloaderd-common/common"
+)
+
+type memoryWriter struct {
+	store *MemoryFileStore
+	buf   *bytes.Buffer
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	w.store.Data = w.buf.Bytes()
+	return nil
+}
+
+type memoryWriterAt struct {
+	sync.Mutex
+	store *MemoryFileStore
+}
+
+func (w *memoryWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	end := int(off) + len(p)
+	if end > len(w.store.Data) {
+		w.store.Data = append(w.store.Data, make([]byte, end-len(w.store.Data))...)
+	}
+	return copy(w.store.Data[off:], p), nil
+}
+
+func (w *memoryWriterAt) Close() error {
+	return nil
+}
+
+type MemoryFileStore struct {
+	Data []byte
+}
+
+func (s *MemoryFileStore) GetWriterAt(d *Download) (WriterAtCloser, error) {
+	s.Data = nil
+	return &memoryWriterAt{store: s}, nil
+}
+
+func (s *MemoryFileStore) Delete(d *Download) (bool, error) {
+	s.Data = nil
+	return true, nil
+}
+
+func (s *MemoryFileStore) GetWriter(d *Download) (io.WriteCloser, error) {
+	return &memoryWriter{store: s, buf: &bytes.Buffer{}}, nil
+}
+
+func (s *MemoryFileStore) GetResumeWriter(d *Download, offset uint64) (io.WriteCloser, error) {
+	return &memoryWriter{store: s, buf: bytes.NewBuffer(s.Data[:offset])}, nil
+}
+
+func (s *MemoryFileStore) GetReader(d *Download) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(s.Data)), nil
+}
+
+func (s *MemoryFileStore) Verify(d *Download) (bool, error) {
+	return true, nil
+}
+
+type RecordingStatusSender struct {
+	Updates []StatusUpdate
+}
+
+func (s *RecordingStatusSender) SendUpdate(update StatusUpdate) {
+	s.Updates = append(s.Updates, update)
+}
+
+func (s *RecordingStatusSender) Started() StatusUpdate {
+	for _, update := range s.Updates {
+		if update.Started {
+			return update
+		}
+	}
+	return StatusUpdate{}
+}
+
+func (s *RecordingStatusSender) Last() StatusUpdate {
+	return s.Updates[len(s.Updates)-1]
+}
+
+const testContent = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+func serveTestContent(etag string, rangeHeader *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		*rangeHeader = req.Header.Get("Range")
+		rw.Header().Set("ETag", etag)
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader(testContent))
+	}))
+}
+
+func createTestWorker(fileStore FileStore, sender StatusSender) *Worker {
+	clock := &common.RealClock{}
+	return &Worker{
+		Clock:        clock,
+		FileStore:    fileStore,
+		ErrorChannel: make(chan Error, 4),
+		StatusSender: sender,
+		Fetchers:     DefaultFetchers(nil, clock)}
+}
+
+func createInterruptedDownload(url string, etag string) *Download {
+	return &Download{
+		ID:           "some-dummy-downloadid",
+		URL:          url,
+		ChecksumType: "sha256",
+		TimeStarted:  time.Now(),
+		Metadata:     &Metadata{ETag: etag},
+		Status:       &Status{BytesRead: 10}}
+}
+
+func expectedTestChecksum() string {
+	sum := sha256.Sum256([]byte(testContent))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSaveResumesFromStoredData(t *testing.T) {
+	var rangeHeader string
+	server := serveTestContent(`"v1"`, &rangeHeader)
+	defer server.Close()
+
+	fileStore := &MemoryFileStore{Data: []byte(testContent[:10])}
+	sender := &RecordingStatusSender{}
+	w := createTestWorker(fileStore, sender)
+
+	w.SaveWithStatus(context.Background(), createInterruptedDownload(server.URL, `"v1"`))
+
+	if rangeHeader != "bytes=10-" {
+		t.Errorf("range: expected %s, got %s", "bytes=10-", rangeHeader)
+	}
+
+	if string(fileStore.Data) != testContent {
+		t.Errorf("data: expected %s, got %s", testContent, fileStore.Data)
+	}
+
+	start := sender.Started()
+	if !start.Started || start.BytesRead != 10 {
+		t.Errorf("start-update: expected started at %d, got %v", 10, start)
+	}
+
+	checksum := sender.Last().Checksum
+	if checksum != expectedTestChecksum() {
+		t.Errorf("checksum: expected %s, got %s", expectedTestChecksum(), checksum)
+	}
+}
+
+func TestSaveUsesWorkerClock(t *testing.T) {
+	var rangeHeader string
+	server := serveTestContent(`"v1"`, &rangeHeader)
+	defer server.Close()
+
+	now := time.Date(2015, time.March, 1, 12, 0, 0, 0, time.UTC)
+	clock := &common.FakeClock{FakeTime: now}
+	sender := &RecordingStatusSender{}
+	w := createTestWorker(&MemoryFileStore{}, sender)
+	w.Clock = clock
+	w.Fetchers = DefaultFetchers(nil, clock)
+
+	d := &Download{ID: "some-id", URL: server.URL, Metadata: &Metadata{}}
+	w.SaveWithStatus(context.Background(), d)
+
+	if !d.TimeStarted.Equal(now) {
+		t.Errorf("time-started: expected %v, got %v", now, d.TimeStarted)
+	}
+	for _, update := range sender.Updates {
+		if update.Metadata != nil && !update.Metadata.TimeRequested.Equal(now) {
+			t.Errorf("time-requested: expected %v, got %v", now, update.Metadata.TimeRequested)
+		}
+	}
+}
+
+func TestSaveRestartsWhenValidatorChanged(t *testing.T) {
+	var rangeHeader string
+	server := serveTestContent(`"v2"`, &rangeHeader)
+	defer server.Close()
+
+	fileStore := &MemoryFileStore{Data: []byte("stale data")}
+	sender := &RecordingStatusSender{}
+	w := createTestWorker(fileStore, sender)
+
+	w.SaveWithStatus(context.Background(), createInterruptedDownload(server.URL, `"v1"`))
+
+	if string(fileStore.Data) != testContent {
+		t.Errorf("data: expected %s, got %s", testContent, fileStore.Data)
+	}
+
+	start := sender.Started()
+	if !start.Started || start.BytesRead != 0 {
+		t.Errorf("start-update: expected started at %d, got %v", 0, start)
+	}
+
+	checksum := sender.Last().Checksum
+	if checksum != expectedTestChecksum() {
+		t.Errorf("checksum: expected %s, got %s", expectedTestChecksum(), checksum)
+	}
+
+	if sender.Last().State != StateSucceeded {
+		t.Errorf("state: expected %s, got %s", StateSucceeded, sender.Last().State)
+	}
+}
+
+func TestSaveSegmented(t *testing.T) {
+	var rangeHeader string
+	server := serveTestContent(`"v1"`, &rangeHeader)
+	defer server.Close()
+
+	fileStore := &MemoryFileStore{}
+	sender := &RecordingStatusSender{}
+	w := createTestWorker(fileStore, sender)
+	w.SegmentCount = 4
+	w.MinSegmentSize = 8
+
+	d := &Download{
+		ID:           "some-dummy-downloadid",
+		URL:          server.URL,
+		ChecksumType: "sha256",
+		Metadata:     &Metadata{},
+		Status:       &Status{}}
+	w.SaveWithStatus(context.Background(), d)
+
+	if string(fileStore.Data) != testContent {
+		t.Errorf("data: expected %s, got %s", testContent, fileStore.Data)
+	}
+
+	if sender.Started().Segments != 4 {
+		t.Errorf("segments: expected %d, got %d", 4, sender.Started().Segments)
+	}
+
+	status := &Status{}
+	for i := range sender.Updates {
+		status.AddStatusUpdate(&sender.Updates[i])
+	}
+	if status.BytesRead != uint64(len(testContent)) {
+		t.Errorf("bytes-read: expected %d, got %d", len(testContent), status.BytesRead)
+	}
+
+	checksum := sender.Last().Checksum
+	if checksum != expectedTestChecksum() {
+		t.Errorf("checksum: expected %s, got %s", expectedTestChecksum(), checksum)
+	}
+}
+
+func TestSaveCancelled(t *testing.T) {
+	var rangeHeader string
+	server := serveTestContent(`"v1"`, &rangeHeader)
+	defer server.Close()
+
+	fileStore := &MemoryFileStore{}
+	sender := &RecordingStatusSender{}
+	w := createTestWorker(fileStore, sender)
+	w.RetryPolicy = DefaultRetryPolicy()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := w.SaveWithStatus(ctx, &Download{
+		ID:           "some-dummy-downloadid",
+		URL:          server.URL,
+		ChecksumType: "sha256",
+		Status:       &Status{}})
+	if err != context.Canceled {
+		t.Errorf("error: expected %v, got %v", context.Canceled, err)
+	}
+
+	if sender.Last().State != StateCancelled {
+		t.Errorf("state: expected %s, got %s", StateCancelled, sender.Last().State)
+	}
+
+	if len(w.ErrorChannel) != 0 {
+		t.Errorf("errors: expected none, got %d", len(w.ErrorChannel))
+	}
+}
@@ -0,0 +1,149 @@
+package ftp
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	goftp "github.com/jlaffaye/ftp"
+
+	"github.com/patdowney/downloaderd-common/common"
+	"github.com/patdowney/downloaderd-worker/download"
+)
+
+// Config ...
+type Config struct {
+	Timeout time.Duration
+	// DisableEPSV makes passive transfers use PASV, for servers and
+	// firewalls that don't understand EPSV.
+	DisableEPSV bool
+	// Addresses limits the hosts connected to, for both the control and
+	// data connections.
+	Addresses *download.AddressPolicy
+}
+
+// Fetcher fetches ftp:// URLs over passive data connections. Credentials
+// come from the download's Auth or the URL, defaulting to an anonymous
+// login.
+type Fetcher struct {
+	Config Config
+	Clock  common.Clock
+}
+
+// NewFetcher ...
+func NewFetcher(c Config) *Fetcher {
+	return &Fetcher{Config: c, Clock: &common.RealClock{}}
+}
+
+func (f *Fetcher) dial(ctx context.Context, u *url.URL, auth *download.Auth) (*goftp.ServerConn, error) {
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "21")
+	}
+
+	dialer := net.Dialer{Timeout: f.Config.Timeout}
+	if f.Config.Addresses != nil {
+		dialer.Control = f.Config.Addresses.Control
+	}
+
+	conn, err := goftp.Dial(address,
+		goftp.DialWithContext(ctx),
+		goftp.DialWithDialer(dialer),
+		goftp.DialWithDisabledEPSV(f.Config.DisableEPSV))
+	if err != nil {
+		return nil, err
+	}
+
+	user, password := "anonymous", "anonymous"
+	if auth != nil && auth.Username != "" {
+		user, password = auth.Username, auth.Password
+	} else if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+
+	err = conn.Login(user, password)
+	if err != nil {
+		conn.Quit()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Fetch continues from offset with REST when the file's modification time
+// matches the one recorded by the earlier attempt.
+func (f *Fetcher) Fetch(ctx context.Context, d *download.Download, offset uint64) (*download.Source, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := f.dial(ctx, u, d.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &download.Metadata{TimeRequested: f.Clock.Now()}
+	size, err := conn.FileSize(u.Path)
+	if err == nil && size >= 0 {
+		metadata.Size = uint64(size)
+	}
+	if conn.IsGetTimeSupported() {
+		modified, err := conn.GetTime(u.Path)
+		if err == nil {
+			metadata.LastModified = modified
+		}
+	}
+
+	start := uint64(0)
+	if offset > 0 && d.Metadata != nil && !metadata.LastModified.IsZero() &&
+		metadata.LastModified.Equal(d.Metadata.LastModified) {
+		start = offset
+	}
+
+	res, err := conn.RetrFrom(u.Path, start)
+	if err != nil {
+		conn.Quit()
+		return nil, err
+	}
+
+	return &download.Source{
+		ReadCloser: newResponse(ctx, conn, res),
+		Offset:     start,
+		Metadata:   metadata}, nil
+}
+
+// response closes the control connection along with the transfer, and
+// when ctx is done so a cancelled download doesn't wait on a stalled read.
+type response struct {
+	*goftp.Response
+	conn *goftp.ServerConn
+	done chan struct{}
+}
+
+func newResponse(ctx context.Context, conn *goftp.ServerConn, res *goftp.Response) *response {
+	r := &response{Response: res, conn: conn, done: make(chan struct{})}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			res.SetDeadline(time.Now())
+		case <-r.done:
+		}
+	}()
+
+	return r
+}
+
+func (r *response) Close() error {
+	close(r.done)
+
+	err := r.Response.Close()
+	r.conn.Quit()
+
+	return err
+}
@@ -0,0 +1,153 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/patdowney/downloaderd-worker/api"
+	"github.com/patdowney/downloaderd-worker/download"
+)
+
+// AdminResource changes how the service runs without restarting it.
+// QuarantineToken is the bearer token needed to fetch the data of
+// infected downloads; without one that route isn't served at all.
+type AdminResource struct {
+	DownloadService *download.Service
+	QuarantineToken string
+}
+
+// NewAdminResource ...
+func NewAdminResource(downloadService *download.Service) *AdminResource {
+	return &AdminResource{DownloadService: downloadService}
+}
+
+// RegisterRoutes ...
+func (r *AdminResource) RegisterRoutes(parentRouter *mux.Router) {
+	parentRouter.HandleFunc("/bandwidth", r.GetBandwidth()).Methods("GET", "HEAD").Name("admin-bandwidth")
+	parentRouter.HandleFunc("/bandwidth", r.PutBandwidth()).Methods("PUT")
+	parentRouter.HandleFunc("/credentials", r.ListCredentials()).Methods("GET", "HEAD").Name("admin-credentials")
+	parentRouter.HandleFunc("/credentials/reload", r.ReloadCredentials()).Methods("POST").Name("admin-credentials-reload")
+	if r.QuarantineToken != "" {
+		parentRouter.HandleFunc("/quarantine/{id:[a-f0-9-]{36}}/data", r.GetQuarantinedData()).Methods("GET", "HEAD").Name("admin-quarantine-data")
+	}
+}
+
+func (r *AdminResource) writeBandwidth(rw http.ResponseWriter) {
+	bandwidth := api.Bandwidth{MaxBytesPerSecond: r.DownloadService.RateLimiter.Rate()}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+
+	encErr := json.NewEncoder(rw).Encode(bandwidth)
+	if encErr != nil {
+		log.Printf("encoder-error-bandwidth: %v", encErr)
+	}
+}
+
+// GetBandwidth ...
+func (r *AdminResource) GetBandwidth() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		r.writeBandwidth(rw)
+	}
+}
+
+// PutBandwidth ...
+func (r *AdminResource) PutBandwidth() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var bandwidth api.Bandwidth
+		err := json.NewDecoder(req.Body).Decode(&bandwidth)
+		if err != nil {
+			log.Printf("bandwidth-request-decode-error: %v", err)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.DownloadService.RateLimiter.SetRate(bandwidth.MaxBytesPerSecond)
+		log.Printf("set-bandwidth: %d bytes/s", bandwidth.MaxBytesPerSecond)
+
+		r.writeBandwidth(rw)
+	}
+}
+
+func (r *AdminResource) writeCredentials(rw http.ResponseWriter) {
+	hosts := download.ToAPICredentialHosts(r.DownloadService.Credentials.Hosts.List())
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+
+	encErr := json.NewEncoder(rw).Encode(hosts)
+	if encErr != nil {
+		log.Printf("encoder-error-credentials: %v", encErr)
+	}
+}
+
+// ListCredentials lists the hosts credentials are configured for, without
+// the credentials themselves.
+func (r *AdminResource) ListCredentials() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		r.writeCredentials(rw)
+	}
+}
+
+// ReloadCredentials ...
+func (r *AdminResource) ReloadCredentials() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		hosts := r.DownloadService.Credentials.Hosts
+		if hosts == nil {
+			http.Error(rw, "no credential files configured", http.StatusNotFound)
+			return
+		}
+
+		err := hosts.Reload()
+		if err != nil {
+			log.Printf("credentials-reload-error: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		r.writeCredentials(rw)
+	}
+}
+
+func (r *AdminResource) quarantineAuthorized(req *http.Request) bool {
+	expected := "Bearer " + r.QuarantineToken
+	return r.QuarantineToken != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+// GetQuarantinedData serves the data of an infected download, which the
+// download resource refuses to, to requests bearing the QuarantineToken.
+func (r *AdminResource) GetQuarantinedData() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		downloadID := mux.Vars(req)["id"]
+
+		if !r.quarantineAuthorized(req) {
+			log.Printf("quarantine-override-refused(%s): missing or wrong token", downloadID)
+			http.Error(rw, "quarantined data needs the admin token", http.StatusForbidden)
+			return
+		}
+
+		d, err := r.DownloadService.FindByID(downloadID)
+		if err != nil {
+			log.Printf("server-error-get-quarantined-data(%s): %v", downloadID, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if d == nil || !d.Infected() {
+			http.Error(rw, "no such infected download", http.StatusNotFound)
+			return
+		}
+
+		reader, err := r.DownloadService.GetReader(d)
+		if err != nil {
+			log.Printf("server-error-get-quarantined-data(%s): %v", downloadID, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("quarantine-override(%s): serving data infected with %s", d.ID, d.Scan.Signature)
+		writeData(rw, d, reader)
+	}
+}
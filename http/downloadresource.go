@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 
 	"github.com/gorilla/mux"
@@ -51,7 +52,13 @@ func (r *DownloadResource) RegisterRoutes(parentRouter *mux.Router) {
 	parentRouter.HandleFunc("/{id:[a-f0-9-]{36}}", r.Get()).Methods("GET", "HEAD").Name("download")
 	parentRouter.HandleFunc("/{id:[a-f0-9-]{36}}", r.Delete()).Methods("DELETE").Name("download-delete")
 	parentRouter.HandleFunc("/{id:[a-f0-9-]{36}}/data", r.GetData()).Methods("GET", "HEAD").Name("download-data")
+	parentRouter.HandleFunc("/{id:[a-f0-9-]{36}}/artifacts/{name:.+}", r.GetArtifact()).Methods("GET", "HEAD").Name("download-artifact")
 	parentRouter.HandleFunc("/{id:[a-f0-9-]{36}}/verify", r.VerifyData()).Methods("GET", "HEAD").Name("download-verify")
+	parentRouter.HandleFunc("/{id:[a-f0-9-]{36}}/cancel", r.Cancel()).Methods("POST").Name("download-cancel")
+	parentRouter.HandleFunc("/{id:[a-f0-9-]{36}}/priority", r.SetPriority()).Methods("PUT").Name("download-priority")
+
+	parentRouter.HandleFunc("/versions", r.Versions()).Methods("GET", "HEAD").Name("download-versions")
+	parentRouter.HandleFunc("/by-checksum/{algo}/{hex:[a-fA-F0-9]+}", r.ByChecksum()).Methods("GET", "HEAD").Name("download-by-checksum")
 
 	// predefined searches
 	parentRouter.HandleFunc("/all", r.Index(r.AllIndex())).Methods("GET", "HEAD")
@@ -60,6 +67,12 @@ func (r *DownloadResource) RegisterRoutes(parentRouter *mux.Router) {
 	parentRouter.HandleFunc("/finished", r.Index(r.FinishedIndex())).Methods("GET", "HEAD")
 	parentRouter.HandleFunc("/finished/stats", r.Stats(r.FinishedIndex())).Methods("GET", "HEAD")
 
+	parentRouter.HandleFunc("/failed", r.Index(r.FailedIndex())).Methods("GET", "HEAD")
+	parentRouter.HandleFunc("/failed/stats", r.Stats(r.FailedIndex())).Methods("GET", "HEAD")
+
+	parentRouter.HandleFunc("/cancelled", r.Index(r.CancelledIndex())).Methods("GET", "HEAD")
+	parentRouter.HandleFunc("/cancelled/stats", r.Stats(r.CancelledIndex())).Methods("GET", "HEAD")
+
 	parentRouter.HandleFunc("/notfinished", r.Index(r.NotFinishedIndex())).Methods("GET", "HEAD")
 	parentRouter.HandleFunc("/notfinished/stats", r.Stats(r.NotFinishedIndex())).Methods("GET", "HEAD")
 
@@ -81,10 +94,19 @@ func (r *DownloadResource) WrapError(err error) *api.Error {
 // IndexFunc ...
 type IndexFunc func() ([]*download.Download, error)
 
-// FinishedIndex ...
+// FinishedIndex lists downloads that succeeded.
 func (r *DownloadResource) FinishedIndex() IndexFunc {
-	return r.DownloadService.ListFinished
+	return r.DownloadService.ListSucceeded
+}
 
+// FailedIndex ...
+func (r *DownloadResource) FailedIndex() IndexFunc {
+	return r.DownloadService.ListFailed
+}
+
+// CancelledIndex ...
+func (r *DownloadResource) CancelledIndex() IndexFunc {
+	return r.DownloadService.ListCancelled
 }
 
 // NotFinishedIndex ...
@@ -135,6 +157,37 @@ func (r *DownloadResource) Index(indexFunc IndexFunc) http.HandlerFunc {
 	}
 }
 
+// Versions lists the retained versions of the download of ?url=.
+func (r *DownloadResource) Versions() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		sourceURL := req.URL.Query().Get("url")
+		if sourceURL == "" {
+			http.Error(rw, "missing url", http.StatusBadRequest)
+			return
+		}
+
+		r.Index(func() ([]*download.Download, error) {
+			return r.DownloadService.ListVersions(sourceURL)
+		})(rw, req)
+	}
+}
+
+// ByChecksum lists the succeeded downloads whose data has the checksum
+// in the path.
+func (r *DownloadResource) ByChecksum() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		if !download.SupportedChecksumType(vars["algo"]) {
+			http.Error(rw, fmt.Sprintf("unsupported checksum type: %s", vars["algo"]), http.StatusBadRequest)
+			return
+		}
+
+		r.Index(func() ([]*download.Download, error) {
+			return r.DownloadService.ListByChecksum(vars["algo"], vars["hex"])
+		})(rw, req)
+	}
+}
+
 // Stats ...
 func (r *DownloadResource) Stats(indexFunc IndexFunc) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
@@ -184,7 +237,7 @@ func (r *DownloadResource) VerifyData() http.HandlerFunc {
 				log.Printf("encoder-error-verify-data(%s): %v", downloadID, encErr)
 			}
 		} else if download != nil {
-			if download.Finished {
+			if download.Succeeded() {
 				ok, err := r.DownloadService.Verify(download)
 				if err != nil {
 					log.Printf("server-error-verify-data(%s): %v", downloadID, err)
@@ -235,7 +288,21 @@ func (r *DownloadResource) GetData() http.HandlerFunc {
 				log.Printf("encoder-error-get-data(%s): %v", downloadID, encErr)
 			}
 		} else if download != nil {
-			if download.Finished {
+			if download.Infected() {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(http.StatusForbidden)
+				encErr := encoder.Encode(r.WrapError(fmt.Errorf("download infected with %s", download.Scan.Signature)))
+				if encErr != nil {
+					log.Printf("encoder-error-get-data(%s): %v", downloadID, encErr)
+				}
+			} else if download.IsFinished() && !download.Succeeded() {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(http.StatusConflict)
+				encErr := encoder.Encode(r.WrapError(fmt.Errorf("download %s", download.State)))
+				if encErr != nil {
+					log.Printf("encoder-error-get-data(%s): %v", downloadID, encErr)
+				}
+			} else if download.Succeeded() {
 				bufferedReader, err := r.DownloadService.GetReader(download)
 				if err != nil {
 					log.Printf("server-error-get-data(%s): %v", downloadID, err)
@@ -248,31 +315,77 @@ func (r *DownloadResource) GetData() http.HandlerFunc {
 					return
 				}
 
-				meta := download.Metadata
+				writeData(rw, download, bufferedReader)
+			} else {
+				rw.WriteHeader(http.StatusNoContent)
+			}
+		} else {
+			rw.WriteHeader(http.StatusNotFound)
+		}
 
-				if meta.MimeType != "" {
-					rw.Header().Set("Content-Type", meta.MimeType)
-				}
-				if meta.Size != 0 {
-					rw.Header().Set("Content-Length", fmt.Sprintf("%d", meta.Size))
-				} else {
-					rw.Header().Set("Content-Length", fmt.Sprintf("%d", download.Status.BytesRead))
-				}
+	}
+}
+
+// writeData sends a download's stored data as an attachment.
+func writeData(rw http.ResponseWriter, d *download.Download, data io.Reader) {
+	contentType := "application/octet-stream"
+	if d.Metadata != nil && d.Metadata.MimeType != "" {
+		contentType = d.Metadata.MimeType
+	}
+	rw.Header().Set("Content-Type", contentType)
+	// what was stored, which can differ from what the origin
+	// advertised if it compressed the response
+	rw.Header().Set("Content-Length", fmt.Sprintf("%d", d.Status.BytesRead))
 
-				u, _ := url.Parse(download.URL)
-				filename := filepath.Base(u.Path)
-				rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	u, _ := url.Parse(d.URL)
+	filename := filepath.Base(u.Path)
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
 
-				rw.WriteHeader(http.StatusOK)
+	rw.WriteHeader(http.StatusOK)
 
-				io.Copy(rw, bufferedReader)
-			} else {
-				rw.WriteHeader(http.StatusNoContent)
+	io.Copy(rw, data)
+}
+
+// GetArtifact serves a file produced by one of the download's processing
+// stages.
+func (r *DownloadResource) GetArtifact() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		downloadID := vars["id"]
+
+		d, err := r.DownloadService.FindByID(downloadID)
+		var artifact *download.Artifact
+		if d != nil && !d.Infected() {
+			artifact = d.Artifact(vars["name"])
+		}
+
+		var reader io.ReadCloser
+		if err == nil && artifact != nil {
+			reader, err = r.DownloadService.GetArtifactReader(d, artifact.Name)
+		}
+
+		if err != nil {
+			log.Printf("server-error-get-artifact(%s): %v", downloadID, err)
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusInternalServerError)
+			encErr := json.NewEncoder(rw).Encode(r.WrapError(err))
+			if encErr != nil {
+				log.Printf("encoder-error-get-artifact(%s): %v", downloadID, encErr)
 			}
-		} else {
+			return
+		}
+		if artifact == nil {
 			rw.WriteHeader(http.StatusNotFound)
+			return
 		}
+		defer reader.Close()
+
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		rw.Header().Set("Content-Length", fmt.Sprintf("%d", artifact.Size))
+		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", path.Base(artifact.Name)))
+		rw.WriteHeader(http.StatusOK)
 
+		io.Copy(rw, reader)
 	}
 }
 
@@ -306,6 +419,95 @@ func (r *DownloadResource) Delete() http.HandlerFunc {
 	}
 }
 
+// Cancel ...
+func (r *DownloadResource) Cancel() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		downloadID := vars["id"]
+
+		cancelledDownload, err := r.DownloadService.Cancel(downloadID)
+
+		encoder := json.NewEncoder(rw)
+		rw.Header().Set("Content-Type", "application/json")
+
+		var stateErr download.StateError
+		if errors.As(err, &stateErr) {
+			rw.WriteHeader(http.StatusConflict)
+			encErr := encoder.Encode(r.WrapError(err))
+			if encErr != nil {
+				log.Printf("encoder-error-cancel(%s): %v", downloadID, encErr)
+			}
+		} else if err != nil {
+			log.Printf("server-error-cancel(%s): %v", downloadID, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			encErr := encoder.Encode(r.WrapError(err))
+			if encErr != nil {
+				log.Printf("encoder-error-cancel(%s): %v", downloadID, encErr)
+			}
+		} else if cancelledDownload != nil {
+			log.Printf("cancelled-download-with-id: %v", downloadID)
+
+			rw.WriteHeader(http.StatusAccepted)
+			d := download.ToAPIDownload(cancelledDownload)
+			r.populateLinks(req, d)
+			encErr := encoder.Encode(d)
+			if encErr != nil {
+				log.Printf("encoder-error-cancel(%s): %v", downloadID, encErr)
+			}
+		} else {
+			log.Printf("cancel-download-not-found: %v", downloadID)
+
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+// SetPriority ...
+func (r *DownloadResource) SetPriority() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		downloadID := vars["id"]
+
+		var update api.PriorityUpdate
+		err := json.NewDecoder(req.Body).Decode(&update)
+		if err != nil {
+			log.Printf("priority-request-decode-error(%s): %v", downloadID, err)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		queuedDownload, err := r.DownloadService.SetPriority(downloadID, update.Priority)
+
+		encoder := json.NewEncoder(rw)
+		rw.Header().Set("Content-Type", "application/json")
+
+		if err == download.ErrNotQueued {
+			rw.WriteHeader(http.StatusConflict)
+			encErr := encoder.Encode(r.WrapError(err))
+			if encErr != nil {
+				log.Printf("encoder-error-priority(%s): %v", downloadID, encErr)
+			}
+		} else if err != nil {
+			log.Printf("server-error-priority(%s): %v", downloadID, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			encErr := encoder.Encode(r.WrapError(err))
+			if encErr != nil {
+				log.Printf("encoder-error-priority(%s): %v", downloadID, encErr)
+			}
+		} else if queuedDownload != nil {
+			rw.WriteHeader(http.StatusOK)
+			d := download.ToAPIDownload(queuedDownload)
+			r.populateLinks(req, d)
+			encErr := encoder.Encode(d)
+			if encErr != nil {
+				log.Printf("encoder-error-priority(%s): %v", downloadID, encErr)
+			}
+		} else {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
 // Get ...
 func (r *DownloadResource) Get() http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
@@ -375,9 +577,26 @@ func (r *DownloadResource) ValidateIncomingDownload(inDown *api.IncomingDownload
 	u, err := url.Parse(inDown.URL)
 	if err != nil {
 		return err
-	} else if u.Scheme != "http" && u.Scheme != "https" {
+	} else if !r.DownloadService.SupportsScheme(u.Scheme) {
 		return fmt.Errorf("unsupported url scheme: '%s'", u.Scheme)
 	}
+
+	err = r.DownloadService.CheckSource(inDown.URL)
+	if err != nil {
+		return err
+	}
+
+	// a checksum without a type is taken to be sha256
+	if inDown.Checksum != "" && inDown.ChecksumType != "" && !download.SupportedChecksumType(inDown.ChecksumType) {
+		return fmt.Errorf("unsupported checksum type: '%s'", inDown.ChecksumType)
+	}
+
+	if inDown.AuthProfile != "" && !r.DownloadService.HasAuthProfile(inDown.AuthProfile) {
+		return fmt.Errorf("unknown auth profile: '%s'", inDown.AuthProfile)
+	}
+	if a := inDown.Auth; a != nil && a.BearerToken != "" && (a.Username != "" || a.Password != "") {
+		return errors.New("auth takes either a bearer token or a username and password")
+	}
 	return nil
 }
 
@@ -404,14 +623,18 @@ func (r *DownloadResource) Post() http.HandlerFunc {
 		}
 
 		downloadReq := download.FromAPIIncomingDownload(incomingDownload)
-		d, err := r.DownloadService.ProcessRequest(downloadReq)
+		d, err := r.DownloadService.ProcessRequest(req.Context(), downloadReq)
 
 		var encErr error
 		encoder := json.NewEncoder(rw)
 		rw.Header().Set("Content-Type", "application/json")
 
-		if err != nil {
-			log.Printf("server-error-post(%s): %v", d.ID, err)
+		if err == download.ErrQueueFull {
+			log.Printf("queue-full-post(%s): %v", downloadReq.URL, err)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			encErr = encoder.Encode(r.WrapError(err))
+		} else if err != nil {
+			log.Printf("server-error-post(%s): %v", downloadReq.URL, err)
 			rw.WriteHeader(http.StatusInternalServerError)
 			encErr = encoder.Encode(r.WrapError(err))
 		} else {
@@ -423,7 +646,7 @@ func (r *DownloadResource) Post() http.HandlerFunc {
 			encErr = encoder.Encode(da)
 		}
 		if encErr != nil {
-			log.Printf("encoder-error-post(%s): %v", d.ID, encErr)
+			log.Printf("encoder-error-post(%s): %v", downloadReq.URL, encErr)
 		}
 	}
 }
@@ -1,8 +1,8 @@
 package local
 
 import (
+	"sort"
 	"sync"
-	"time"
 
 	"github.com/patdowney/downloaderd-common/local"
 	"github.com/patdowney/downloaderd-worker/download"
@@ -44,17 +44,54 @@ func (s *DownloadStore) Add(download *download.Download) error {
 	return err
 }
 
-// Update ...
+// Update replaces the stored download, keeping any sources added and any
+// blob set since it was read.
 func (s *DownloadStore) Update(download *download.Download) error {
 	s.Lock()
-	d, err := s.FindByID(download.ID)
-	if err == nil {
+	d := s.findByID(download.ID)
+	if d != nil {
+		sources := d.Sources
+		blob := d.Blob
 		*d = *download
+		if d.Blob == "" {
+			d.Blob = blob
+		}
+		d.Sources = append([]string(nil), download.Sources...)
+		for _, source := range sources {
+			d.AddSource(source)
+		}
 	}
 	s.Unlock()
-	err = s.Commit()
 
-	return err
+	return s.Commit()
+}
+
+// AddSource ...
+func (s *DownloadStore) AddSource(downloadID string, sourceURL string) (*download.Download, error) {
+	s.Lock()
+	d := s.findByID(downloadID)
+	added := d != nil && d.AddSource(sourceURL)
+	s.Unlock()
+
+	if !added {
+		return d, nil
+	}
+	return d, s.Commit()
+}
+
+// SetBlob ...
+func (s *DownloadStore) SetBlob(downloadID string, checksum string) error {
+	s.Lock()
+	d := s.findByID(downloadID)
+	if d != nil {
+		d.Blob = checksum
+	}
+	s.Unlock()
+
+	if d == nil {
+		return nil
+	}
+	return s.Commit()
 }
 
 // Commit ...
@@ -62,24 +99,43 @@ func (s *DownloadStore) Commit() error {
 	return s.SaveToDisk(s.repository)
 }
 
-func (s *DownloadStore) purgeUnfinished() error {
-	newRepository := make([]*download.Download, 0, len(s.repository))
-
-	for _, download := range s.repository {
-		if download.Finished {
-			newRepository = append(newRepository, download)
-		}
-	}
-	s.repository = newRepository
-	return nil
+// legacyDownload picks out the Finished flag from data files written
+// before downloads had a State.
+type legacyDownload struct {
+	Finished bool
 }
 
 func (s *DownloadStore) load() error {
 	err := s.LoadFromDisk(&s.repository)
+	if err != nil {
+		return err
+	}
 
-	s.purgeUnfinished()
+	var legacy []legacyDownload
+	err = s.LoadFromDisk(&legacy)
+	if err != nil {
+		return err
+	}
 
-	return err
+	for i, d := range s.repository {
+		if d.State == "" {
+			d.State = download.StateQueued
+			if legacy[i].Finished {
+				d.State = download.StateSucceeded
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *DownloadStore) findByID(downloadID string) *download.Download {
+	for _, download := range s.repository {
+		if download.ID == downloadID {
+			return download
+		}
+	}
+	return nil
 }
 
 // FindByID ...
@@ -87,31 +143,32 @@ func (s *DownloadStore) FindByID(downloadID string) (*download.Download, error)
 	s.RLock()
 	defer s.RUnlock()
 
-	for _, download := range s.repository {
-		if download.ID == downloadID {
-			return download, nil
-		}
-	}
-	return nil, nil
+	return s.findByID(downloadID), nil
 }
 
-// FindByResourceKey ...
+// FindByResourceKey returns the version of the resource with a matching
+// ETag, or the most recently requested one.
 func (s *DownloadStore) FindByResourceKey(resourceKey download.ResourceKey) (*download.Download, error) {
 	s.RLock()
 	defer s.RUnlock()
 
-	for _, download := range s.repository {
-		if download.URL == resourceKey.URL {
-			if download.Metadata != nil {
-				if download.Metadata.ETag == resourceKey.ETag {
-					return download, nil
-
-				}
-			}
+	var latest *download.Download
+	for i := len(s.repository) - 1; i >= 0; i-- {
+		download := s.repository[i]
+		if download.URL != resourceKey.URL {
+			continue
+		}
+		if resourceKey.ETag == "" {
+			return download, nil
+		}
+		if download.Metadata != nil && download.Metadata.ETag == resourceKey.ETag {
 			return download, nil
 		}
+		if latest == nil {
+			latest = download
+		}
 	}
-	return nil, nil
+	return latest, nil
 }
 
 // FindAll ...
@@ -125,83 +182,75 @@ func (s *DownloadStore) FindAll(offset uint, count uint) ([]*download.Download,
 	return tmpRepository, nil
 }
 
-// FindFinished ...
-func (s *DownloadStore) FindFinished(offset uint, count uint) ([]*download.Download, error) {
-	s.RLock()
-	defer s.RUnlock()
-
+// findMatching filters the repository before applying offset and count,
+// so paging through a listing doesn't skip entries.
+func (s *DownloadStore) findMatching(offset uint, count uint, matches func(*download.Download) bool) []*download.Download {
 	var tmpRepository []*download.Download
-	//tmpRepository := make([]*download.Download, 0)
 
-	repoSlice := s.sliceRepository(offset, count)
-	for _, download := range repoSlice {
-		if download.Finished {
+	for _, download := range s.repository {
+		if matches(download) {
 			tmpRepository = append(tmpRepository, download)
 		}
 	}
 
-	return tmpRepository, nil
+	return sliceDownloads(tmpRepository, offset, count)
 }
 
-// FindNotFinished ...
-func (s *DownloadStore) FindNotFinished(offset uint, count uint) ([]*download.Download, error) {
-	s.RLock()
-	defer s.RUnlock()
-
-	var tmpRepository []*download.Download
-
-	repoSlice := s.sliceRepository(offset, count)
-	for _, download := range repoSlice {
-		if !download.Finished {
-			tmpRepository = append(tmpRepository, download)
-		}
+func sliceDownloads(downloads []*download.Download, offset uint, count uint) []*download.Download {
+	length := uint(len(downloads))
+	if offset > length {
+		offset = length
 	}
-
-	return tmpRepository, nil
+	end := offset + count
+	if end > length {
+		end = length
+	}
+	return downloads[offset:end]
 }
 
-// FindInProgress ...
-func (s *DownloadStore) FindInProgress(offset uint, count uint) ([]*download.Download, error) {
+// FindByState ...
+func (s *DownloadStore) FindByState(state download.State, offset uint, count uint) ([]*download.Download, error) {
 	s.RLock()
 	defer s.RUnlock()
 
-	var tmpRepository []*download.Download
-	var beginningOfTime time.Time
+	return s.findMatching(offset, count, func(d *download.Download) bool {
+		return d.State == state
+	}), nil
+}
 
-	repoSlice := s.sliceRepository(offset, count)
-	for _, download := range repoSlice {
-		if !download.Finished {
-			if download.TimeStarted.After(beginningOfTime) {
-				tmpRepository = append(tmpRepository, download)
-			}
-		}
-	}
+// FindVersions ...
+func (s *DownloadStore) FindVersions(sourceURL string, offset uint, count uint) ([]*download.Download, error) {
+	s.RLock()
+	defer s.RUnlock()
 
-	return tmpRepository, nil
-}
+	versions := s.findMatching(0, uint(len(s.repository)), func(d *download.Download) bool {
+		return d.URL == sourceURL
+	})
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].VersionNumber() > versions[j].VersionNumber()
+	})
 
-func (s *DownloadStore) sliceRepository(offset uint, count uint) []*download.Download {
-	return s.repository[offset:(offset + count)]
+	return sliceDownloads(versions, offset, count), nil
 }
 
-// FindWaiting ...
-func (s *DownloadStore) FindWaiting(offset uint, count uint) ([]*download.Download, error) {
+// FindByChecksum ...
+func (s *DownloadStore) FindByChecksum(checksumType string, checksum string, offset uint, count uint) ([]*download.Download, error) {
 	s.RLock()
 	defer s.RUnlock()
 
-	var tmpRepository []*download.Download
-	var beginningOfTime time.Time
+	return s.findMatching(offset, count, func(d *download.Download) bool {
+		return d.State == download.StateSucceeded && d.HasChecksum(checksumType, checksum)
+	}), nil
+}
 
-	repoSlice := s.sliceRepository(offset, count)
-	for _, download := range repoSlice {
-		if !download.Finished {
-			if download.TimeStarted.UTC() == beginningOfTime.UTC() {
-				tmpRepository = append(tmpRepository, download)
-			}
-		}
-	}
+// FindNotFinished ...
+func (s *DownloadStore) FindNotFinished(offset uint, count uint) ([]*download.Download, error) {
+	s.RLock()
+	defer s.RUnlock()
 
-	return tmpRepository, nil
+	return s.findMatching(offset, count, func(d *download.Download) bool {
+		return !d.IsFinished()
+	}), nil
 }
 
 // NewDownloadStore ...
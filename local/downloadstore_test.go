@@ -0,0 +1,87 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/patdowney/downloaderd-worker/download"
+)
+
+func TestDownloadStoreKeepsAddedSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "downloadstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dataFile := filepath.Join(dir, "downloads.json")
+	ioutil.WriteFile(dataFile, []byte("[]"), 0644)
+
+	s, err := NewDownloadStore(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(&download.Download{ID: "existing", URL: "http://one.example.com/data"})
+
+	// a copy read before the source was added, as a worker would hold
+	stale := *s.findByID("existing")
+
+	for i := 0; i < 2; i++ {
+		d, err := s.AddSource("existing", "http://two.example.com/data")
+		if err != nil || d == nil {
+			t.Fatalf("add source: %v, %v", d, err)
+		}
+	}
+
+	stale.State = download.StateSucceeded
+	err = s.Update(&stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, _ := s.FindByID("existing")
+	if d.State != download.StateSucceeded {
+		t.Errorf("state: expected %s, got %s", download.StateSucceeded, d.State)
+	}
+	if len(d.Sources) != 1 || d.Sources[0] != "http://two.example.com/data" {
+		t.Errorf("sources: expected %v, got %v", []string{"http://two.example.com/data"}, d.Sources)
+	}
+}
+
+func TestDownloadStoreKeepsSetBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "downloadstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dataFile := filepath.Join(dir, "downloads.json")
+	ioutil.WriteFile(dataFile, []byte("[]"), 0644)
+
+	s, err := NewDownloadStore(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(&download.Download{ID: "existing", URL: "http://one.example.com/data"})
+
+	// a copy read before the worker moved the data into a blob
+	stale := *s.findByID("existing")
+
+	err = s.SetBlob("existing", "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale.State = download.StateSucceeded
+	err = s.Update(&stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, _ := s.FindByID("existing")
+	if d.Blob != "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e" {
+		t.Errorf("blob: expected it kept, got %q", d.Blob)
+	}
+}
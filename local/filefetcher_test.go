@@ -0,0 +1,71 @@
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/patdowney/downloaderd-worker/download"
+)
+
+func TestFileFetcherRestrictsToRoots(t *testing.T) {
+	root, err := ioutil.TempDir("", "filefetcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	allowedDir := filepath.Join(root, "allowed")
+	os.Mkdir(allowedDir, 0755)
+	ioutil.WriteFile(filepath.Join(allowedDir, "data.txt"), []byte("0123456789"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(allowedDir, "link.txt"))
+
+	f := NewFileFetcher([]string{allowedDir})
+
+	source, err := f.Fetch(context.Background(), &download.Download{URL: "file://" + filepath.Join(allowedDir, "data.txt")}, 0)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	data, _ := ioutil.ReadAll(source)
+	source.Close()
+	if string(data) != "0123456789" || source.Metadata.Size != 10 {
+		t.Errorf("data: expected %s, got %s", "0123456789", data)
+	}
+
+	for _, name := range []string{"allowed/../secret.txt", "allowed/link.txt"} {
+		_, err := f.Fetch(context.Background(), &download.Download{URL: "file://" + filepath.Join(root, name)}, 0)
+		if err == nil {
+			t.Errorf("fetch(%s): expected file outside the roots to be refused", name)
+		}
+	}
+}
+
+func TestFileFetcherResumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filefetcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data.txt")
+	ioutil.WriteFile(path, []byte("0123456789"), 0644)
+	info, _ := os.Stat(path)
+
+	d := &download.Download{
+		URL:      "file://" + path,
+		Metadata: &download.Metadata{LastModified: info.ModTime()}}
+
+	source, err := NewFileFetcher([]string{dir}).Fetch(context.Background(), d, 4)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	defer source.Close()
+
+	data, _ := ioutil.ReadAll(source)
+	if source.Offset != 4 || string(data) != "456789" {
+		t.Errorf("resume: expected %s from %d, got %s from %d", "456789", 4, data, source.Offset)
+	}
+}
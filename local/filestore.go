@@ -1,12 +1,15 @@
 package local
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/patdowney/downloaderd-worker/download"
 )
@@ -14,6 +17,12 @@ import (
 // FileStore ...
 type FileStore struct {
 	RootDirectory string
+	// ContentAddressed moves finished downloads into blobs named by the
+	// sha256 of their data, so identical data is only kept once.
+	ContentAddressed bool
+
+	// blobLock guards the reference lists kept with each blob.
+	blobLock sync.Mutex
 }
 
 // NewFileStore ...
@@ -28,9 +37,30 @@ func (us *FileStore) SavePathFromURL(sourceURL string) string {
 	return filepath.Join(urlObj.Host, urlObj.Path)
 }
 
-// SavePathForDownload ...
+// SavePathForDownload keeps each version of a URL in its own file next
+// to the URL's path. Downloads from before versions were kept live at the
+// URL's path itself, quarantined downloads are kept apart by ID and
+// downloads moved into a blob are read from there.
 func (us *FileStore) SavePathForDownload(download *download.Download) (string, error) {
+	if download.Quarantined {
+		return us.quarantinePath(download), nil
+	}
+	if download.Blob != "" {
+		return us.blobPath(download.Blob)
+	}
+
+	return us.downloadPath(download)
+}
+
+// downloadPath is where a download is written before it is finished.
+// Versions are named path@vN-ID, so they never turn the URL's path into a
+// directory, and as IDs hold no @ no other URL, version or query string
+// can name the same file.
+func (us *FileStore) downloadPath(download *download.Download) (string, error) {
 	savePathFromURL := us.SavePathFromURL(download.URL)
+	if download.Version > 0 {
+		savePathFromURL = fmt.Sprintf("%s@v%d-%s", savePathFromURL, download.Version, download.ID)
+	}
 	cleanRootDirectory := filepath.Clean(us.RootDirectory)
 	dirtySavePath := filepath.Join(us.RootDirectory, savePathFromURL)
 	cleanSavePath := filepath.Clean(dirtySavePath)
@@ -43,6 +73,198 @@ func (us *FileStore) SavePathForDownload(download *download.Download) (string, e
 	return cleanSavePath, nil
 }
 
+func (us *FileStore) quarantinePath(download *download.Download) string {
+	return filepath.Join(us.RootDirectory, ".quarantine", download.ID)
+}
+
+// Quarantine moves a download's data out of the save tree, dropping
+// anything produced from it.
+func (us *FileStore) Quarantine(download *download.Download) error {
+	if download.Quarantined {
+		return nil
+	}
+
+	savePath, err := us.SavePathForDownload(download)
+	if err != nil {
+		return err
+	}
+
+	err = us.DeleteArtifacts(download)
+	if err != nil {
+		return err
+	}
+
+	quarantinePath := us.quarantinePath(download)
+	err = os.MkdirAll(filepath.Dir(quarantinePath), os.ModeDir|0700)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(savePath, quarantinePath)
+}
+
+// blobPath spreads blobs over directories named by the first byte of
+// their checksum.
+func (us *FileStore) blobPath(checksum string) (string, error) {
+	_, err := hex.DecodeString(checksum)
+	if err != nil || len(checksum) != 64 {
+		return "", fmt.Errorf("localurlsaver: invalid blob checksum: '%s'", checksum)
+	}
+
+	return filepath.Join(us.RootDirectory, ".blobs", "sha256", checksum[:2], checksum), nil
+}
+
+// StoresBlobs ...
+func (us *FileStore) StoresBlobs() bool {
+	return us.ContentAddressed
+}
+
+// Commit moves a finished download's data into the blob for checksum. If
+// the blob is already stored the download's copy is dropped instead.
+func (us *FileStore) Commit(d *download.Download, checksum string) error {
+	blobPath, err := us.blobPath(checksum)
+	if err != nil {
+		return err
+	}
+	savePath, err := us.downloadPath(d)
+	if err != nil {
+		return err
+	}
+
+	us.blobLock.Lock()
+	defer us.blobLock.Unlock()
+
+	_, err = os.Stat(blobPath)
+	switch {
+	case err == nil:
+		err = os.Remove(savePath)
+	case os.IsNotExist(err):
+		err = os.MkdirAll(filepath.Dir(blobPath), os.ModeDir|0755)
+		if err == nil {
+			err = os.Rename(savePath, blobPath)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return us.updateRefs(blobPath, func(refs download.BlobRefs) download.BlobRefs {
+		return refs.Add(d.ID)
+	})
+}
+
+// release drops a download's reference to its blob, deleting the blob
+// once nothing refers to it. It reports whether the blob was deleted.
+func (us *FileStore) release(d *download.Download) (bool, error) {
+	blobPath, err := us.blobPath(d.Blob)
+	if err != nil {
+		return false, err
+	}
+
+	us.blobLock.Lock()
+	defer us.blobLock.Unlock()
+
+	var remaining int
+	err = us.updateRefs(blobPath, func(refs download.BlobRefs) download.BlobRefs {
+		refs = refs.Remove(d.ID)
+		remaining = len(refs)
+		return refs
+	})
+	if err != nil || remaining > 0 {
+		return false, err
+	}
+
+	err = os.Remove(blobPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// updateRefs rewrites the reference list kept next to a blob, removing it
+// when it is left empty. Callers hold blobLock.
+func (us *FileStore) updateRefs(blobPath string, update func(download.BlobRefs) download.BlobRefs) error {
+	refsPath := blobPath + ".refs"
+
+	data, err := ioutil.ReadFile(refsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	refs := update(download.ParseBlobRefs(data))
+	if len(refs) == 0 {
+		err = os.Remove(refsPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return ioutil.WriteFile(refsPath, refs.Bytes(), 0644)
+}
+
+// LocalPath ...
+func (us *FileStore) LocalPath(download *download.Download) (string, error) {
+	return us.SavePathForDownload(download)
+}
+
+// artifactPath keeps a download's artifacts in a directory next to where
+// its data was written, which isn't shared with other downloads even once
+// the data is in a blob.
+func (us *FileStore) artifactPath(download *download.Download, name string) (string, error) {
+	savePath, err := us.downloadPath(download)
+	if err != nil {
+		return "", err
+	}
+
+	artifactDir := savePath + ".artifacts"
+	artifactPath := filepath.Join(artifactDir, filepath.FromSlash(name))
+	if !strings.HasPrefix(artifactPath, artifactDir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("localurlsaver: %s doesn't contain %s", artifactDir, artifactPath)
+	}
+
+	return artifactPath, nil
+}
+
+// GetArtifactWriter ...
+func (us *FileStore) GetArtifactWriter(download *download.Download, name string) (io.WriteCloser, error) {
+	artifactPath, err := us.artifactPath(download, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(artifactPath), os.ModeDir|0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Create(artifactPath)
+}
+
+// GetArtifactReader ...
+func (us *FileStore) GetArtifactReader(download *download.Download, name string) (io.ReadCloser, error) {
+	artifactPath, err := us.artifactPath(download, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(artifactPath)
+}
+
+// DeleteArtifacts ...
+func (us *FileStore) DeleteArtifacts(download *download.Download) error {
+	savePath, err := us.downloadPath(download)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(savePath + ".artifacts")
+}
+
 // GetReader ...
 func (us *FileStore) GetReader(download *download.Download) (io.ReadCloser, error) {
 	dataPath, err := us.SavePathForDownload(download)
@@ -60,7 +282,7 @@ func (us *FileStore) GetReader(download *download.Download) (io.ReadCloser, erro
 
 // GetWriter ...
 func (us *FileStore) GetWriter(download *download.Download) (io.WriteCloser, error) {
-	savePath, err := us.SavePathForDownload(download)
+	savePath, err := us.downloadPath(download)
 	if err != nil {
 		return nil, err
 	}
@@ -78,14 +300,63 @@ func (us *FileStore) GetWriter(download *download.Download) (io.WriteCloser, err
 	return saveFile, nil
 }
 
-// Delete ...
+// GetWriterAt ...
+func (us *FileStore) GetWriterAt(download *download.Download) (download.WriterAtCloser, error) {
+	savePath, err := us.downloadPath(download)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(savePath), os.ModeDir|0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Create(savePath)
+}
+
+// GetResumeWriter ...
+func (us *FileStore) GetResumeWriter(download *download.Download, offset uint64) (io.WriteCloser, error) {
+	savePath, err := us.downloadPath(download)
+	if err != nil {
+		return nil, err
+	}
+
+	saveFile, err := os.OpenFile(savePath, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop anything written past the point the hash was rebuilt to
+	err = saveFile.Truncate(int64(offset))
+	if err == nil {
+		_, err = saveFile.Seek(int64(offset), io.SeekStart)
+	}
+	if err != nil {
+		saveFile.Close()
+		return nil, err
+	}
+
+	return saveFile, nil
+}
+
+// Delete removes a download's data, or its reference to the blob holding
+// the data. Data that isn't there counts as deleted.
 func (us *FileStore) Delete(download *download.Download) (bool, error) {
+	if download.Blob != "" && !download.Quarantined {
+		return us.release(download)
+	}
+
 	dataPath, err := us.SavePathForDownload(download)
 	if err != nil {
 		return false, err
 	}
 
+	// already gone, or never written
 	err = os.Remove(dataPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,133 @@
+package local
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/patdowney/downloaderd-worker/download"
+)
+
+func writeDownload(t *testing.T, fileStore *FileStore, d *download.Download, data string) {
+	writer, err := fileStore.GetWriter(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(data))
+	writer.Close()
+}
+
+func TestFileStoreSharesBlobs(t *testing.T) {
+	root, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	fileStore := NewFileStore(root)
+	fileStore.ContentAddressed = true
+
+	sum := sha256.Sum256([]byte("0123456789"))
+	checksum := hex.EncodeToString(sum[:])
+
+	first := &download.Download{ID: "first", URL: "http://one.example.com/data.txt"}
+	second := &download.Download{ID: "second", URL: "http://two.example.com/data.txt"}
+	for _, d := range []*download.Download{first, second} {
+		writeDownload(t, fileStore, d, "0123456789")
+
+		err = fileStore.Commit(d, checksum)
+		if err != nil {
+			t.Fatalf("commit(%s): %v", d.ID, err)
+		}
+		savePath, _ := fileStore.downloadPath(d)
+		if _, err := os.Stat(savePath); !os.IsNotExist(err) {
+			t.Errorf("commit(%s): data left at %s", d.ID, savePath)
+		}
+		d.Blob = checksum
+	}
+
+	blobPath, _ := fileStore.blobPath(checksum)
+	refs, _ := ioutil.ReadFile(blobPath + ".refs")
+	if string(refs) != "first\nsecond\n" {
+		t.Errorf("refs: expected %q, got %q", "first\nsecond\n", refs)
+	}
+
+	deleted, err := fileStore.Delete(first)
+	if err != nil || deleted {
+		t.Fatalf("delete(first): expected blob kept, got %v, %v", deleted, err)
+	}
+
+	reader, err := fileStore.GetReader(second)
+	if err != nil {
+		t.Fatalf("get reader(second): %v", err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "0123456789" {
+		t.Errorf("data: expected %s, got %s", "0123456789", data)
+	}
+
+	deleted, err = fileStore.Delete(second)
+	if err != nil || !deleted {
+		t.Fatalf("delete(second): expected blob deleted, got %v, %v", deleted, err)
+	}
+	for _, p := range []string{blobPath, blobPath + ".refs"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("delete(second): %s left behind", p)
+		}
+	}
+}
+
+func TestFileStoreKeepsVersionsApart(t *testing.T) {
+	root, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	fileStore := NewFileStore(root)
+
+	downloads := []*download.Download{
+		// from before versions were kept
+		{ID: "legacy", URL: "http://example.com/data"},
+		{ID: "first", URL: "http://example.com/data", Version: 1},
+		{ID: "second", URL: "http://example.com/data", Version: 2},
+		{ID: "parent", URL: "http://example.com/pkg", Version: 2},
+		{ID: "nested", URL: "http://example.com/pkg/v2", Version: 1},
+		{ID: "query-one", URL: "http://example.com/list?a=1", Version: 1},
+		{ID: "query-two", URL: "http://example.com/list?a=2", Version: 1},
+	}
+	for _, d := range downloads {
+		writeDownload(t, fileStore, d, d.ID)
+	}
+
+	for _, d := range downloads {
+		reader, err := fileStore.GetReader(d)
+		if err != nil {
+			t.Errorf("get reader(%s): %v", d.ID, err)
+			continue
+		}
+		data, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if string(data) != d.ID {
+			t.Errorf("data(%s): expected %s, got %s", d.ID, d.ID, data)
+		}
+	}
+}
+
+func TestFileStoreDeleteMissingData(t *testing.T) {
+	root, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	fileStore := NewFileStore(root)
+
+	deleted, err := fileStore.Delete(&download.Download{ID: "queued", URL: "http://example.com/data", Version: 1})
+	if err != nil || deleted {
+		t.Errorf("delete: expected nothing deleted and no error, got %v, %v", deleted, err)
+	}
+}
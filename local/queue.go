@@ -0,0 +1,132 @@
+package local
+
+import (
+	"sync"
+
+	"github.com/patdowney/downloaderd-common/local"
+	"github.com/patdowney/downloaderd-worker/download"
+)
+
+// Queue is a download.Queue saved to a JSON file on every change, so
+// waiting downloads survive a restart.
+type Queue struct {
+	local.JSONStore
+	sync.Mutex
+	available *sync.Cond
+	items     []download.QueueItem
+}
+
+// Push ...
+func (q *Queue) Push(item download.QueueItem) error {
+	q.Lock()
+	defer q.Unlock()
+
+	i := q.indexOf(item.DownloadID)
+	if i >= 0 {
+		q.items[i].Host = item.Host
+		q.items[i].Priority = item.Priority
+	} else {
+		q.items = append(q.items, item)
+	}
+	q.available.Broadcast()
+
+	return q.commit()
+}
+
+// Pop ...
+func (q *Queue) Pop(claim download.ClaimFunc) (download.QueueItem, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	next := download.NextQueueItem(q.items, claim)
+	for next < 0 {
+		q.available.Wait()
+		next = download.NextQueueItem(q.items, claim)
+	}
+
+	item := q.items[next]
+	q.items = append(q.items[:next], q.items[next+1:]...)
+
+	return item, q.commit()
+}
+
+// Remove ...
+func (q *Queue) Remove(downloadID string) (bool, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	i := q.indexOf(downloadID)
+	if i < 0 {
+		return false, nil
+	}
+	q.items = append(q.items[:i], q.items[i+1:]...)
+
+	return true, q.commit()
+}
+
+// SetPriority ...
+func (q *Queue) SetPriority(downloadID string, priority int) (bool, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	i := q.indexOf(downloadID)
+	if i < 0 {
+		return false, nil
+	}
+	q.items[i].Priority = priority
+	q.available.Broadcast()
+
+	return true, q.commit()
+}
+
+// Wake ...
+func (q *Queue) Wake() {
+	q.Lock()
+	q.available.Broadcast()
+	q.Unlock()
+}
+
+// List returns the queued items in the order workers will take them.
+func (q *Queue) List() ([]download.QueueItem, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	items := make([]download.QueueItem, len(q.items))
+	copy(items, q.items)
+	download.SortQueueItems(items)
+
+	return items, nil
+}
+
+// Len ...
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.items)
+}
+
+func (q *Queue) indexOf(downloadID string) int {
+	for i, item := range q.items {
+		if item.DownloadID == downloadID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *Queue) commit() error {
+	return q.SaveToDisk(q.items)
+}
+
+// NewQueue ...
+func NewQueue(dataFile string) (*Queue, error) {
+	queue := &Queue{
+		items: make([]download.QueueItem, 0)}
+	queue.available = sync.NewCond(&queue.Mutex)
+
+	queue.DataFile = dataFile
+	err := queue.LoadFromDisk(&queue.items)
+
+	return queue, err
+}
@@ -2,28 +2,89 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	http "github.com/patdowney/downloaderd-common/http"
 	"github.com/patdowney/downloaderd-worker/api"
 	"github.com/patdowney/downloaderd-worker/download"
+	"github.com/patdowney/downloaderd-worker/ftp"
 	dh "github.com/patdowney/downloaderd-worker/http"
 	"github.com/patdowney/downloaderd-worker/local"
+	"github.com/patdowney/downloaderd-worker/s3"
 	//"github.com/patdowney/downloaderd-common/rethinkdb"
 	//"github.com/patdowney/downloaderd-worker/rethinkdb"
-	//"github.com/patdowney/downloaderd-worker/s3"
 )
 
 // Config ...
 type Config struct {
-	ListenAddress     string
-	WorkerCount       uint
-	QueueLength       uint
-	DownloadDirectory string
-	DownloadDataFile  string
-	HookDataFile      string
+	ListenAddress   string
+	WorkerCount     uint
+	QueueLength     uint
+	SegmentCount    uint
+	MaxAttempts     uint
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	DownloadDirectory        string
+	ContentAddressed         bool
+	DownloadDataFile         string
+	HookDataFile             string
+	QueueDataFile            string
+	DeleteOnChecksumMismatch bool
+	QuarantineToken          string
+
+	MaxBytesPerSecond uint64
+	Preflight         bool
+
+	FileRoots  string
+	FTPTimeout time.Duration
+	FTPPASV    bool
+	S3Sources  bool
+	S3Region   string
+
+	AuthProfileFile          string
+	NetrcFile                string
+	CredentialFile           string
+	CredentialReloadInterval time.Duration
+
+	HostConnections uint
+	HostDelay       time.Duration
+	HostPolicies    hostPolicyFlag
+
+	Proxy      string
+	NoProxy    string
+	ProxyRules proxyRuleFlag
+
+	MaxRedirects           uint
+	RedirectSameHost       bool
+	RedirectHosts          string
+	RedirectAllowDowngrade bool
+
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleReadTimeout       time.Duration
+	StallWindow           time.Duration
+	StallBytesPerSecond   uint64
+
+	AllowedAddresses string
+	DeniedAddresses  string
+
+	MaxSize      uint64
+	AllowedTypes string
+	DeniedTypes  string
+
+	CABundles          string
+	ClientCertificates clientCertificateFlag
+	Pins               pinFlag
+
+	Stages       stageFlag
+	StageWorkDir string
 
 	AccessLogWriter io.Writer
 	ErrorLogWriter  io.Writer
@@ -31,6 +92,94 @@ type Config struct {
 	RethinkDBAddress string
 }
 
+// hostPolicyFlag collects repeated -hostpolicy flags.
+type hostPolicyFlag []download.HostPolicy
+
+func (f *hostPolicyFlag) String() string {
+	return fmt.Sprintf("%v", *f)
+}
+
+func (f *hostPolicyFlag) Set(value string) error {
+	policy, err := download.ParseHostPolicy(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, policy)
+	return nil
+}
+
+// proxyRuleFlag collects repeated -proxyrule flags.
+type proxyRuleFlag []download.ProxyRule
+
+func (f *proxyRuleFlag) String() string {
+	return fmt.Sprintf("%v", *f)
+}
+
+func (f *proxyRuleFlag) Set(value string) error {
+	rule, err := download.ParseProxyRule(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, rule)
+	return nil
+}
+
+// clientCertificateFlag collects repeated -clientcert flags.
+type clientCertificateFlag []download.ClientCertificate
+
+func (f *clientCertificateFlag) String() string {
+	patterns := make([]string, len(*f))
+	for i, c := range *f {
+		patterns[i] = c.Pattern
+	}
+	return strings.Join(patterns, ",")
+}
+
+func (f *clientCertificateFlag) Set(value string) error {
+	certificate, err := download.ParseClientCertificate(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, certificate)
+	return nil
+}
+
+// pinFlag collects repeated -pin flags.
+type pinFlag []download.Pin
+
+func (f *pinFlag) String() string {
+	return fmt.Sprintf("%v", *f)
+}
+
+func (f *pinFlag) Set(value string) error {
+	pin, err := download.ParsePin(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, pin)
+	return nil
+}
+
+// stageFlag collects repeated -stage flags, in the order they run.
+type stageFlag []download.Stage
+
+func (f *stageFlag) String() string {
+	names := make([]string, len(*f))
+	for i, stage := range *f {
+		names[i] = stage.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *stageFlag) Set(value string) error {
+	stage, err := download.ParseStage(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, stage)
+	return nil
+}
+
 // ConfigureLogging ...
 func ConfigureLogging(config *Config) {
 	log.SetOutput(config.ErrorLogWriter)
@@ -42,11 +191,56 @@ func ParseArgs() *Config {
 	c := &Config{}
 	flag.StringVar(&c.ListenAddress, "http", "localhost:8080", "address to listen on")
 	flag.UintVar(&c.WorkerCount, "workers", 2, "number of workers to use")
-	flag.UintVar(&c.QueueLength, "queuelength", 32, "size of download queue")
+	flag.UintVar(&c.QueueLength, "queuelength", 32, "number of downloads that can wait for a worker, 0 for no limit")
+	flag.UintVar(&c.SegmentCount, "segments", 1, "number of parallel ranges to fetch large downloads in")
+	flag.UintVar(&c.MaxAttempts, "attempts", 5, "number of times to try a download before giving up")
+	flag.DurationVar(&c.RetryBackoff, "retrybackoff", time.Second, "delay before the first retry, doubled for each one after")
+	flag.DurationVar(&c.MaxRetryBackoff, "maxretrybackoff", 5*time.Minute, "longest delay between retries")
+	flag.Uint64Var(&c.MaxBytesPerSecond, "maxbytespersecond", 0, "bandwidth cap shared by all workers, 0 for no limit")
+	flag.BoolVar(&c.Preflight, "preflight", false, "send a HEAD request for metadata before each download")
+	flag.StringVar(&c.FileRoots, "fileroots", "", "comma separated directories file:// urls may be fetched from")
+	flag.DurationVar(&c.FTPTimeout, "ftptimeout", 30*time.Second, "timeout for connecting to ftp servers")
+	flag.BoolVar(&c.FTPPASV, "ftppasv", false, "use PASV rather than EPSV for ftp transfers")
+	flag.BoolVar(&c.S3Sources, "s3sources", false, "fetch s3:// urls using credentials from the environment")
+	flag.StringVar(&c.S3Region, "s3region", "us-east-1", "region of s3:// sources")
+	flag.StringVar(&c.AuthProfileFile, "authprofiles", "", "json file of named credentials downloads may use")
+	flag.StringVar(&c.NetrcFile, "netrc", "", "netrc file of credentials for origin hosts")
+	flag.StringVar(&c.CredentialFile, "credentials", "", "json or yaml file of credentials for origin hosts and path prefixes")
+	flag.DurationVar(&c.CredentialReloadInterval, "credentialsreload", 30*time.Second, "how often to check credential files for changes, 0 to never")
+	flag.UintVar(&c.HostConnections, "hostconnections", 0, "connections allowed to each host without a policy, 0 for no limit")
+	flag.DurationVar(&c.HostDelay, "hostdelay", 0, "delay between requests to each host without a policy")
+	flag.Var(&c.HostPolicies, "hostpolicy", "per host limits as host=connections[/delay], host may be *.domain, repeatable")
+	flag.StringVar(&c.Proxy, "proxy", "", "http, https or socks5 proxy url for outbound requests")
+	flag.StringVar(&c.NoProxy, "noproxy", "", "comma separated hosts, domains and cidr ranges to reach without the proxy")
+	flag.Var(&c.ProxyRules, "proxyrule", "per host proxy as host=proxy-url or host=direct, host may be *.domain, repeatable")
+	flag.UintVar(&c.MaxRedirects, "maxredirects", download.DefaultMaxRedirects, "number of redirects to follow, 0 to follow none")
+	flag.BoolVar(&c.RedirectSameHost, "redirectsamehost", false, "only follow redirects to the host originally requested")
+	flag.StringVar(&c.RedirectHosts, "redirecthosts", "", "comma separated hosts redirects may lead to, host may be *.domain")
+	flag.BoolVar(&c.RedirectAllowDowngrade, "redirectdowngrade", false, "follow redirects from https to http")
+	flag.DurationVar(&c.ConnectTimeout, "connecttimeout", 30*time.Second, "timeout for connecting to origins and proxies")
+	flag.DurationVar(&c.TLSHandshakeTimeout, "tlstimeout", 10*time.Second, "timeout for tls handshakes")
+	flag.DurationVar(&c.ResponseHeaderTimeout, "headertimeout", time.Minute, "timeout for response headers once a request is sent, 0 for none")
+	flag.DurationVar(&c.IdleReadTimeout, "idletimeout", 2*time.Minute, "longest wait for more of a response body, 0 for none")
+	flag.DurationVar(&c.StallWindow, "stallwindow", 0, "abort attempts reading less than -stallbytespersecond over this long, 0 to never")
+	flag.Uint64Var(&c.StallBytesPerSecond, "stallbytespersecond", 0, "slowest throughput allowed over -stallwindow")
+	flag.StringVar(&c.AllowedAddresses, "allowaddresses", "", "comma separated cidr ranges downloads may connect to despite being loopback, private or link-local")
+	flag.StringVar(&c.DeniedAddresses, "denyaddresses", "", "comma separated cidr ranges downloads may never connect to")
+	flag.Uint64Var(&c.MaxSize, "maxsize", 0, "largest download in bytes, 0 for no limit")
+	flag.StringVar(&c.AllowedTypes, "allowtypes", "", "comma separated mime types downloads may have, such as application/* or text/csv")
+	flag.StringVar(&c.DeniedTypes, "denytypes", "", "comma separated mime types downloads may not have, such as text/html")
+	flag.StringVar(&c.CABundles, "cabundles", "", "comma separated pem files of ca certificates to trust alongside the system roots")
+	flag.Var(&c.ClientCertificates, "clientcert", "client certificate for hosts as host=cert-file,key-file, host may be *.domain, repeatable")
+	flag.Var(&c.Pins, "pin", "pinned keys for hosts as host=spki-sha256[,spki-sha256], host may be *.domain, repeatable")
+	flag.Var(&c.Stages, "stage", "processing stage run on finished downloads as scan=clamd:address, scan=command:path [args], extract, decompress, checksum[=type,type] or command=path [args], repeatable, run in order")
+	flag.StringVar(&c.StageWorkDir, "stagedir", "", "scratch directory for processing stages, defaults to the system temporary directory")
+	flag.BoolVar(&c.DeleteOnChecksumMismatch, "deletemismatched", false, "delete downloads that don't match their requested checksum")
+	flag.StringVar(&c.QuarantineToken, "quarantinetoken", "", "bearer token for fetching infected data from /admin/quarantine, which isn't served without one")
 	flag.StringVar(&c.RethinkDBAddress, "rethinkdb", "localhost:28015", "address to listen on")
 	flag.StringVar(&c.DownloadDirectory, "downloaddir", "./download-data", "root directory of save tree.")
+	flag.BoolVar(&c.ContentAddressed, "contentaddressed", false, "keep finished downloads by the sha256 of their data, sharing identical data")
 	flag.StringVar(&c.DownloadDataFile, "downloaddata", "downloads.json", "download database file")
 	flag.StringVar(&c.HookDataFile, "hookdata", "hooks.json", "hooks database file")
+	flag.StringVar(&c.QueueDataFile, "queuedata", "queue.json", "download queue file")
 	flag.Parse()
 
 	c.AccessLogWriter = os.Stdout
@@ -55,6 +249,78 @@ func ParseArgs() *Config {
 	return c
 }
 
+func configureFetchers(config *Config, downloadService *download.Service) {
+	ftpFetcher := ftp.NewFetcher(ftp.Config{
+		Timeout:     config.FTPTimeout,
+		DisableEPSV: config.FTPPASV,
+		Addresses:   downloadService.Addresses})
+	ftpFetcher.Clock = downloadService.Clock
+	downloadService.Fetchers["ftp"] = ftpFetcher
+
+	if config.FileRoots != "" {
+		roots := strings.Split(config.FileRoots, ",")
+		fileFetcher := local.NewFileFetcher(roots)
+		fileFetcher.Clock = downloadService.Clock
+		downloadService.Fetchers["file"] = fileFetcher
+	}
+
+	if config.S3Sources {
+		s3Fetcher, err := s3.NewFetcher(s3.Config{RegionName: config.S3Region})
+		if err != nil {
+			log.Printf("s3-init-fetcher-error: %v", err)
+		} else {
+			s3Fetcher.HTTP.Client = downloadService.HTTPClient
+			downloadService.Fetchers["s3"] = s3Fetcher
+		}
+	}
+}
+
+func configureProxies(config *Config, proxies *download.ProxyConfig) {
+	if config.Proxy != "" {
+		proxy, err := download.ParseProxyURL(config.Proxy)
+		if err != nil {
+			log.Fatalf("init-proxy-error: %v", err)
+		}
+		proxies.Default = proxy
+	}
+	proxies.NoProxy = download.ParseNoProxy(config.NoProxy)
+	proxies.Rules = config.ProxyRules
+}
+
+func configureTLS(config *Config, tlsConfig *download.TLSConfig) {
+	if config.CABundles != "" {
+		pool, err := download.LoadCertPool(strings.Split(config.CABundles, ","))
+		if err != nil {
+			log.Fatalf("init-ca-bundles-error: %v", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	tlsConfig.ClientCertificates = config.ClientCertificates
+	tlsConfig.Pins = config.Pins
+}
+
+func configureRedirects(config *Config, redirects *download.RedirectPolicy) {
+	redirects.MaxRedirects = config.MaxRedirects
+	redirects.SameHost = config.RedirectSameHost
+	redirects.AllowDowngrade = config.RedirectAllowDowngrade
+	if config.RedirectHosts != "" {
+		redirects.AllowedHosts = strings.Split(strings.ToLower(config.RedirectHosts), ",")
+	}
+}
+
+func configureAddresses(config *Config, addresses *download.AddressPolicy) {
+	allow, err := download.ParseCIDRs(config.AllowedAddresses)
+	if err != nil {
+		log.Fatalf("init-allow-addresses-error: %v", err)
+	}
+	deny, err := download.ParseCIDRs(config.DeniedAddresses)
+	if err != nil {
+		log.Fatalf("init-deny-addresses-error: %v", err)
+	}
+	addresses.Allow = allow
+	addresses.Deny = deny
+}
+
 // CreateServer ...
 func CreateServer(config *Config) {
 	s := http.NewServer(&http.Config{ListenAddress: config.ListenAddress}, os.Stdout)
@@ -73,6 +339,7 @@ func CreateServer(config *Config) {
 	}
 
 	fileStore := local.NewFileStore(config.DownloadDirectory)
+	fileStore.ContentAddressed = config.ContentAddressed
 	//c3 := s3.Config{BucketName: "downloaderd", RegionName: "us-east-1"}
 	//fileStore, err := s3.NewFileStore(c3)
 	//if err != nil {
@@ -85,16 +352,72 @@ func CreateServer(config *Config) {
 		log.Printf("init-hook-store-error: %v", err)
 	}
 
+	queue, err := local.NewQueue(config.QueueDataFile)
+	if err != nil {
+		log.Printf("init-queue-error: %v", err)
+	}
+
 	linkResolver := api.NewLinkResolver(s.Router)
 	linkResolver.DefaultScheme = "http"
 	linkResolver.DefaultHost = config.ListenAddress
 
-	downloadService := download.NewDownloadService(downloadStore, fileStore, config.WorkerCount, config.QueueLength)
+	downloadService := download.NewDownloadService(downloadStore, fileStore, queue, config.WorkerCount, config.QueueLength)
+	downloadService.SegmentCount = config.SegmentCount
+	downloadService.RetryPolicy.MaxAttempts = config.MaxAttempts
+	downloadService.RetryPolicy.InitialBackoff = config.RetryBackoff
+	downloadService.RetryPolicy.MaxBackoff = config.MaxRetryBackoff
+	downloadService.DeleteOnChecksumMismatch = config.DeleteOnChecksumMismatch
+	downloadService.RateLimiter.SetRate(config.MaxBytesPerSecond)
+	downloadService.Preflight = config.Preflight
+	configureFetchers(config, downloadService)
+	if config.AuthProfileFile != "" {
+		profiles, err := download.LoadAuthProfiles(config.AuthProfileFile)
+		if err != nil {
+			log.Printf("init-auth-profiles-error: %v", err)
+		} else {
+			downloadService.Credentials.SetProfiles(profiles)
+		}
+	}
+	if config.NetrcFile != "" || config.CredentialFile != "" {
+		hosts, err := download.NewHostCredentials(config.NetrcFile, config.CredentialFile)
+		if err != nil {
+			log.Printf("init-credentials-error: %v", err)
+		}
+		if config.CredentialReloadInterval > 0 {
+			hosts.Watch(config.CredentialReloadInterval)
+		}
+		downloadService.Credentials.Hosts = hosts
+	}
+	downloadService.HostLimiter.Default = download.HostPolicy{MaxConnections: config.HostConnections, Delay: config.HostDelay}
+	downloadService.HostLimiter.Policies = config.HostPolicies
+	configureProxies(config, downloadService.Proxies)
+	configureTLS(config, downloadService.TLS)
+	configureRedirects(config, downloadService.Redirects)
+	configureAddresses(config, downloadService.Addresses)
+	*downloadService.Timeouts = download.Timeouts{
+		Connect:        config.ConnectTimeout,
+		TLSHandshake:   config.TLSHandshakeTimeout,
+		ResponseHeader: config.ResponseHeaderTimeout,
+		IdleRead:       config.IdleReadTimeout}
+	*downloadService.Limits = download.Limits{
+		MaxSize:      config.MaxSize,
+		AllowedTypes: download.ParseMimeTypes(config.AllowedTypes),
+		DeniedTypes:  download.ParseMimeTypes(config.DeniedTypes)}
+	*downloadService.StallPolicy = download.StallPolicy{
+		MinBytesPerSecond: config.StallBytesPerSecond,
+		Window:            config.StallWindow}
+	*downloadService.Pipeline = download.Pipeline{
+		Stages:  config.Stages,
+		WorkDir: config.StageWorkDir}
 	downloadService.HookService = download.NewHookService(hookStore, linkResolver)
 
 	downloadResource := dh.NewDownloadResource(downloadService, linkResolver)
 	s.AddResource("/download", downloadResource)
 
+	adminResource := dh.NewAdminResource(downloadService)
+	adminResource.QuarantineToken = config.QuarantineToken
+	s.AddResource("/admin", adminResource)
+
 	downloadService.Start()
 
 	err = s.ListenAndServe()
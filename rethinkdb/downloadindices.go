@@ -9,3 +9,9 @@ func URLETagIndex(row r.Term) interface{} {
 		row.Field("URL"),
 		row.Field("Metadata").Field("ETag")}
 }
+
+func ChecksumIndex(row r.Term) interface{} {
+	return []interface{}{
+		row.Field("ChecksumType").Downcase(),
+		row.Field("Checksum").Downcase()}
+}
@@ -17,7 +17,22 @@ func (s *DownloadStore) createIndexes() error {
 		return err
 	}
 
-	err = s.IndexCreate("Finished")
+	err = s.IndexCreate("State")
+	if err != nil {
+		return err
+	}
+
+	err = s.IndexCreate("URL")
+	if err != nil {
+		return err
+	}
+
+	err = s.IndexCreateWithFunc("Checksum", ChecksumIndex)
+	if err != nil {
+		return err
+	}
+
+	err = s.IndexCreate("Blob")
 	if err != nil {
 		return err
 	}
@@ -42,21 +57,52 @@ func (s *DownloadStore) Add(download *download.Download) error {
 	return err
 }
 
+// Update replaces the stored download, keeping any sources added and any
+// blob set since it was read.
 func (s *DownloadStore) Update(download *download.Download) error {
-	_, err := s.Get(download.ID).Update(download).RunWrite(s.Session)
+	sources := download.Sources
+	if sources == nil {
+		sources = []string{}
+	}
+
+	_, err := s.Get(download.ID).Update(func(row r.Term) interface{} {
+		kept := map[string]interface{}{
+			"Sources": row.Field("Sources").Default([]string{}).SetUnion(sources)}
+		if download.Blob == "" {
+			kept["Blob"] = row.Field("Blob").Default("")
+		}
+		return r.Expr(download).Merge(kept)
+	}).RunWrite(s.Session)
 	return err
 }
 
-func (s *DownloadStore) purgeIncomplete() error {
-	s.GetAllByIndex("Finished", true).Filter(IsIncomplete()).Delete().RunWrite(s.Session)
+func (s *DownloadStore) SetBlob(downloadID string, checksum string) error {
+	_, err := s.Get(downloadID).Update(map[string]interface{}{"Blob": checksum}).RunWrite(s.Session)
+	return err
+}
 
-	return nil
+func (s *DownloadStore) AddSource(downloadID string, sourceURL string) (*download.Download, error) {
+	_, err := s.Get(downloadID).Update(map[string]interface{}{
+		"Sources": r.Row.Field("Sources").Default([]string{}).SetInsert(sourceURL)}).RunWrite(s.Session)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.FindByID(downloadID)
 }
 
-func (s *DownloadStore) purgeUnfinished() error {
-	s.GetAllByIndex("Finished", false).Delete().RunWrite(s.Session)
+// migrateFinished gives downloads stored before they had a State one
+// based on their old Finished flag, dropping the flag so each download is
+// only migrated once.
+func (s *DownloadStore) migrateFinished() error {
+	_, err := s.BaseTerm().Filter(r.Row.HasFields("State").Not()).
+		Replace(func(row r.Term) interface{} {
+			state := r.Branch(row.Field("Finished").Default(false),
+				download.StateSucceeded, download.StateQueued)
+			return row.Without("Finished").Merge(map[string]interface{}{"State": state})
+		}).RunWrite(s.Session)
 
-	return nil
+	return err
 }
 
 func (s *DownloadStore) getSingleDownload(term r.Term) (*download.Download, error) {
@@ -85,7 +131,8 @@ func (s *DownloadStore) FindByID(downloadID string) (*download.Download, error)
 }
 
 func (s *DownloadStore) FindByResourceKey(resourceKey download.ResourceKey) (*download.Download, error) {
-	resourceKeyLookup := s.GetAllByIndex("ResourceKey", []interface{}{resourceKey.URL, resourceKey.ETag})
+	resourceKeyLookup := s.GetAllByIndex("ResourceKey", []interface{}{resourceKey.URL, resourceKey.ETag}).
+		OrderBy(r.Desc("TimeRequested")).Limit(1)
 
 	return s.getSingleDownload(resourceKeyLookup)
 }
@@ -106,28 +153,33 @@ func (s *DownloadStore) getMultiDownload(term r.Term, offset uint, count uint) (
 	return results, nil
 }
 
-func (s *DownloadStore) FindWaiting(offset uint, count uint) ([]*download.Download, error) {
-	notStartedLookup := s.GetAllByIndex("Finished", false).Filter(NotStarted())
+func (s *DownloadStore) FindVersions(sourceURL string, offset uint, count uint) ([]*download.Download, error) {
+	versionLookup := s.GetAllByIndex("URL", sourceURL).OrderBy(r.Desc("Version"))
 
-	return s.getMultiDownload(notStartedLookup, offset, count)
+	return s.getMultiDownload(versionLookup, offset, count)
 }
 
-func (s *DownloadStore) FindNotFinished(offset uint, count uint) ([]*download.Download, error) {
-	notFinishedLookup := s.GetAllByIndex("Finished", false)
+func (s *DownloadStore) FindByChecksum(checksumType string, checksum string, offset uint, count uint) ([]*download.Download, error) {
+	checksumLookup := s.GetAllByIndex("Checksum", []interface{}{checksumType, checksum})
+	if checksumType == "sha256" {
+		checksumLookup = checksumLookup.Union(s.GetAllByIndex("Blob", checksum)).Distinct()
+	}
+	checksumLookup = checksumLookup.Filter(r.Row.Field("State").Eq(download.StateSucceeded))
 
-	return s.getMultiDownload(notFinishedLookup, offset, count)
+	return s.getMultiDownload(checksumLookup, offset, count)
 }
 
-func (s *DownloadStore) FindFinished(offset uint, count uint) ([]*download.Download, error) {
-	finishedLookup := s.GetAllByIndex("Finished", true)
+func (s *DownloadStore) FindByState(state download.State, offset uint, count uint) ([]*download.Download, error) {
+	stateLookup := s.GetAllByIndex("State", state)
 
-	return s.getMultiDownload(finishedLookup, offset, count)
+	return s.getMultiDownload(stateLookup, offset, count)
 }
 
-func (s *DownloadStore) FindInProgress(offset uint, count uint) ([]*download.Download, error) {
-	inProgressLookup := s.GetAllByIndex("Finished", false).Filter(Started())
+func (s *DownloadStore) FindNotFinished(offset uint, count uint) ([]*download.Download, error) {
+	notFinishedLookup := s.GetAllByIndex("State", download.StateQueued).
+		Union(s.GetAllByIndex("State", download.StateRunning))
 
-	return s.getMultiDownload(inProgressLookup, offset, count)
+	return s.getMultiDownload(notFinishedLookup, offset, count)
 }
 
 func (s *DownloadStore) FindAll(offset uint, count uint) ([]*download.Download, error) {
@@ -139,8 +191,8 @@ func (s *DownloadStore) FindAll(offset uint, count uint) ([]*download.Download,
 func (s *DownloadStore) Init() error {
 	s.createIndexes()
 
-	s.purgeUnfinished()
-	s.purgeIncomplete()
+	// unfinished downloads are kept so they can be resumed
+	s.migrateFinished()
 
 	return nil
 }
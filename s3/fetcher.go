@@ -0,0 +1,62 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/amz.v1/aws"
+
+	"github.com/patdowney/downloaderd-worker/download"
+)
+
+// signedURLLifetime only has to cover the start of the request.
+const signedURLLifetime = time.Hour
+
+// Fetcher fetches s3://bucket/key URLs. Objects are read through a signed
+// URL, so they can be resumed with range requests like any HTTP download.
+type Fetcher struct {
+	Auth   aws.Auth
+	Region aws.Region
+	HTTP   *download.HTTPFetcher
+}
+
+// NewFetcher ...
+func NewFetcher(c Config) (*Fetcher, error) {
+	auth, err := authFromEnvOrConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Fetcher{
+		Auth:   auth,
+		Region: aws.Regions[c.RegionName],
+		HTTP:   &download.HTTPFetcher{}}, nil
+}
+
+// Fetch ...
+func (f *Fetcher) Fetch(ctx context.Context, d *download.Download, offset uint64) (*download.Source, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := openBucket(f.Auth, f.Region, u.Host)
+	signedURL := bucket.SignedURL(strings.TrimPrefix(u.Path, "/"), time.Now().Add(signedURLLifetime))
+
+	source, err := f.HTTP.FetchURL(ctx, signedURL, nil, d.Metadata, offset)
+
+	// errors name the download's URL rather than the signed one
+	var httpErr download.HTTPError
+	var urlErr *url.Error
+	if errors.As(err, &httpErr) {
+		httpErr.URL = d.URL
+		return nil, httpErr
+	} else if errors.As(err, &urlErr) {
+		urlErr.URL = d.URL
+	}
+
+	return source, err
+}
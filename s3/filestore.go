@@ -1,11 +1,13 @@
 package s3
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net/url"
 	"path/filepath"
+	"sync"
 
 	"gopkg.in/amz.v1/aws"
 	"gopkg.in/amz.v1/s3"
@@ -16,6 +18,14 @@ import (
 // FileStore ...
 type FileStore struct {
 	Bucket *s3.Bucket
+	// ContentAddressed moves finished downloads into blobs keyed by the
+	// sha256 of their data, so identical data is only kept once.
+	ContentAddressed bool
+
+	// blobLock guards the reference lists kept with each blob. They are
+	// only safe from other processes sharing the bucket if those don't
+	// write blobs too.
+	blobLock sync.Mutex
 }
 
 // Config ...
@@ -66,8 +76,18 @@ func (s *FileStore) SavePathFromURL(sourceURL string) string {
 	return filepath.Join(urlObj.Host, urlObj.Path)
 }
 
-// SavePathForDownload ...
+// SavePathForDownload returns the key a download's data is read from,
+// which is its blob once it has been moved into one.
 func (s *FileStore) SavePathForDownload(download *download.Download) (string, error) {
+	if download.Blob != "" {
+		return s.blobKey(download.Blob)
+	}
+
+	return s.downloadKey(download)
+}
+
+// downloadKey is where a download is written before it is finished.
+func (s *FileStore) downloadKey(download *download.Download) (string, error) {
 	urlObj, err := url.Parse(download.URL)
 	if err != nil {
 		return "", err
@@ -76,6 +96,135 @@ func (s *FileStore) SavePathForDownload(download *download.Download) (string, er
 	return p, nil
 }
 
+// blobKey ...
+func (s *FileStore) blobKey(checksum string) (string, error) {
+	_, err := hex.DecodeString(checksum)
+	if err != nil || len(checksum) != 64 {
+		return "", fmt.Errorf("s3: invalid blob checksum: '%s'", checksum)
+	}
+
+	return "blobs/sha256/" + checksum, nil
+}
+
+// StoresBlobs ...
+func (s *FileStore) StoresBlobs() bool {
+	return s.ContentAddressed
+}
+
+// Commit copies a finished download's data into the blob for checksum,
+// unless the blob is already stored, and deletes the download's own copy.
+func (s *FileStore) Commit(d *download.Download, checksum string) error {
+	blobKey, err := s.blobKey(checksum)
+	if err != nil {
+		return err
+	}
+	savePath, err := s.downloadKey(d)
+	if err != nil {
+		return err
+	}
+
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	exists, err := s.exists(blobKey)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if d.Metadata == nil || d.Metadata.Size == 0 {
+			return fmt.Errorf("s3: unknown size for download:%s", d.ID)
+		}
+
+		reader, err := s.Bucket.GetReader(savePath)
+		if err != nil {
+			return err
+		}
+		err = s.s3upload(reader, blobKey, int64(d.Metadata.Size), d.Metadata.MimeType)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.Bucket.Del(savePath)
+	if err != nil {
+		return err
+	}
+
+	return s.updateRefs(blobKey, func(refs download.BlobRefs) download.BlobRefs {
+		return refs.Add(d.ID)
+	})
+}
+
+// release drops a download's reference to its blob, deleting the blob
+// once nothing refers to it. It reports whether the blob was deleted.
+func (s *FileStore) release(d *download.Download) (bool, error) {
+	blobKey, err := s.blobKey(d.Blob)
+	if err != nil {
+		return false, err
+	}
+
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	var remaining int
+	err = s.updateRefs(blobKey, func(refs download.BlobRefs) download.BlobRefs {
+		refs = refs.Remove(d.ID)
+		remaining = len(refs)
+		return refs
+	})
+	if err != nil || remaining > 0 {
+		return false, err
+	}
+
+	err = s.Bucket.Del(blobKey)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// updateRefs rewrites the reference list kept in the object next to a
+// blob, deleting it when it is left empty. Callers hold blobLock.
+func (s *FileStore) updateRefs(blobKey string, update func(download.BlobRefs) download.BlobRefs) error {
+	refsKey := blobKey + ".refs"
+
+	exists, err := s.exists(refsKey)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if exists {
+		data, err = s.Bucket.Get(refsKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	refs := update(download.ParseBlobRefs(data))
+	if len(refs) == 0 {
+		if !exists {
+			return nil
+		}
+		return s.Bucket.Del(refsKey)
+	}
+
+	return s.Bucket.Put(refsKey, refs.Bytes(), "text/plain", s3.BucketOwnerFull)
+}
+
+// exists reports whether there is an object at s3Key itself, rather than
+// just one it is a prefix of.
+func (s *FileStore) exists(s3Key string) (bool, error) {
+	listResponse, err := s.Bucket.List(s3Key, "", "", 1)
+	if err != nil {
+		return false, err
+	}
+
+	return len(listResponse.Contents) == 1 && listResponse.Contents[0].Key == s3Key, nil
+}
+
 // GetReader ...
 func (s *FileStore) GetReader(download *download.Download) (io.ReadCloser, error) {
 	dataPath, err := s.SavePathForDownload(download)
@@ -97,16 +246,42 @@ func (s *FileStore) GetWriter(download *download.Download) (io.WriteCloser, erro
 		return nil, err
 	}
 
+	// uploads are streamed, so S3 has to be told the length up front
+	if download.Metadata == nil || download.Metadata.Size == 0 {
+		return nil, fmt.Errorf("s3: unknown size for download:%s", download.ID)
+	}
+
 	pipeReader, pipeWriter := io.Pipe()
+	writer := &uploadWriter{PipeWriter: pipeWriter, done: make(chan error, 1)}
 
 	go func() {
 		err := s.s3upload(pipeReader, savePath, int64(download.Metadata.Size), download.Metadata.MimeType)
 		if err != nil {
 			log.Printf("s3-upload-failed for download:%s, savePath:%s, error:%s", download.ID, savePath, err.Error())
 		}
+		pipeReader.CloseWithError(err)
+		writer.done <- err
 	}()
 
-	return pipeWriter, nil
+	return writer, nil
+}
+
+// uploadWriter waits for the upload to finish when it is closed, so the
+// object is there to commit or verify once the download is written.
+type uploadWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *uploadWriter) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+// GetResumeWriter ...
+func (s *FileStore) GetResumeWriter(download *download.Download, offset uint64) (io.WriteCloser, error) {
+	// objects can't be appended to, so partial uploads are never kept
+	return nil, fmt.Errorf("s3: unable to resume download:%s at offset %d", download.ID, offset)
 }
 
 func (s *FileStore) getFileInfo(s3Key string) (*s3.Key, error) {
@@ -123,8 +298,13 @@ func (s *FileStore) getFileInfo(s3Key string) (*s3.Key, error) {
 	return &listResponse.Contents[0], nil
 }
 
-// Delete ...
+// Delete removes a download's data, or its reference to the blob holding
+// the data.
 func (s *FileStore) Delete(download *download.Download) (bool, error) {
+	if download.Blob != "" {
+		return s.release(download)
+	}
+
 	savePath, err := s.SavePathForDownload(download)
 	if err != nil {
 		return false, err
@@ -0,0 +1,22 @@
+package s3
+
+import (
+	"testing"
+
+	"github.com/patdowney/downloaderd-worker/download"
+)
+
+func TestSavePathForBlobDownload(t *testing.T) {
+	s := &FileStore{}
+	checksum := "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e"
+
+	savePath, err := s.SavePathForDownload(&download.Download{ID: "some-id", URL: "http://example.com/data", Blob: checksum})
+	if err != nil || savePath != "blobs/sha256/"+checksum {
+		t.Errorf("blob: expected %s, got %s, %v", "blobs/sha256/"+checksum, savePath, err)
+	}
+
+	_, err = s.SavePathForDownload(&download.Download{ID: "some-id", URL: "http://example.com/data", Blob: "../data"})
+	if err == nil {
+		t.Errorf("invalid blob: expected an error")
+	}
+}